@@ -0,0 +1,319 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// AdminIntentsResponse is the response body of the admin intent list endpoint.
+type AdminIntentsResponse struct {
+	Bot     id.UserID   `json:"bot"`
+	Intents []id.UserID `json:"intents"`
+	Clients []id.UserID `json:"clients"`
+}
+
+// AdminRoomStateResponse is the response body of the admin room state endpoint.
+type AdminRoomStateResponse struct {
+	RoomID      id.RoomID                               `json:"room_id"`
+	Members     map[id.UserID]*event.MemberEventContent `json:"members,omitempty"`
+	PowerLevels *event.PowerLevelsEventContent          `json:"power_levels,omitempty"`
+	Typing      []id.UserID                             `json:"typing"`
+}
+
+// AdminProcessorInfo describes the handlers registered in a running EventProcessor.
+type AdminProcessorInfo struct {
+	ExecMode          ExecMode       `json:"exec_mode"`
+	Handlers          map[string]int `json:"handlers"`
+	ToDeviceHandlers  map[string]int `json:"to_device_handlers"`
+	CatchAllHandlers  int            `json:"catch_all_handlers"`
+	ClassHandlers     map[string]int `json:"class_handlers"`
+	UnhandledHandlers int            `json:"unhandled_handlers"`
+	Pool              *PoolStats     `json:"pool,omitempty"`
+}
+
+// AdminHandlersResponse is the response body of the admin handler list endpoint.
+type AdminHandlersResponse struct {
+	Processors []AdminProcessorInfo `json:"processors"`
+}
+
+type eventProcessors struct {
+	processors map[*EventProcessor]struct{}
+	lock       sync.Mutex
+}
+
+func (eps *eventProcessors) add(ep *EventProcessor) {
+	eps.lock.Lock()
+	defer eps.lock.Unlock()
+	if eps.processors == nil {
+		eps.processors = make(map[*EventProcessor]struct{})
+	}
+	eps.processors[ep] = struct{}{}
+}
+
+func (eps *eventProcessors) remove(ep *EventProcessor) {
+	eps.lock.Lock()
+	defer eps.lock.Unlock()
+	delete(eps.processors, ep)
+}
+
+func (eps *eventProcessors) list() []*EventProcessor {
+	eps.lock.Lock()
+	defer eps.lock.Unlock()
+	list := make([]*EventProcessor, 0, len(eps.processors))
+	for ep := range eps.processors {
+		list = append(list, ep)
+	}
+	return list
+}
+
+func countHandlers(handlers map[event.Type][]EventHandler) map[string]int {
+	counts := make(map[string]int, len(handlers))
+	for evtType, typeHandlers := range handlers {
+		counts[evtType.Type] += len(typeHandlers)
+	}
+	return counts
+}
+
+func countClassHandlers(handlers map[event.TypeClass][]EventHandler) map[string]int {
+	counts := make(map[string]int, len(handlers))
+	for class, classHandlers := range handlers {
+		counts[class.Name()] += len(classHandlers)
+	}
+	return counts
+}
+
+// registerAdminAPI adds the admin API endpoints to the router if an admin token is configured.
+// handlerInfo counts the registered handlers of the event processor.
+// The counts are made under the same lock as registering handlers, so it's safe to call while handlers are added.
+func (ep *EventProcessor) handlerInfo() AdminProcessorInfo {
+	ep.handlersLock.RLock()
+	defer ep.handlersLock.RUnlock()
+	return AdminProcessorInfo{
+		ExecMode:         ep.ExecMode,
+		Handlers:         countHandlers(ep.handlers),
+		ToDeviceHandlers: countHandlers(ep.toDeviceHandlers),
+
+		CatchAllHandlers:  len(ep.catchAllHandlers),
+		ClassHandlers:     countClassHandlers(ep.classHandlers),
+		UnhandledHandlers: len(ep.unhandledHandlers),
+	}
+}
+
+func (as *AppService) registerAdminAPI() {
+	if len(as.AdminToken) == 0 {
+		return
+	}
+	router := as.Router.PathPrefix("/_appservice/admin/v1").Subrouter()
+	router.Use(as.adminAuthMiddleware)
+	router.HandleFunc("/intents", as.GetAdminIntents).Methods(http.MethodGet)
+	router.HandleFunc("/rooms/{roomID}/state", as.GetAdminRoomState).Methods(http.MethodGet)
+	router.HandleFunc("/rooms/{roomID}/refresh", as.PostAdminRefreshRoom).Methods(http.MethodPost)
+	router.HandleFunc("/queue", as.GetAdminQueue).Methods(http.MethodGet)
+	router.HandleFunc("/handlers", as.GetAdminHandlers).Methods(http.MethodGet)
+	router.HandleFunc("/dead_letters", as.GetAdminDeadLetters).Methods(http.MethodGet)
+	router.HandleFunc("/dead_letters/{letterID}", as.GetAdminDeadLetter).Methods(http.MethodGet)
+	router.HandleFunc("/dead_letters/{letterID}", as.DeleteAdminDeadLetter).Methods(http.MethodDelete)
+	router.HandleFunc("/dead_letters/{letterID}/replay", as.PostAdminReplayDeadLetter).Methods(http.MethodPost)
+}
+
+func (as *AppService) adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(as.AdminToken)) != 1 {
+			Error{
+				ErrorCode:  ErrForbidden,
+				HTTPStatus: http.StatusForbidden,
+				Message:    "Bad token supplied.",
+			}.Write(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetAdminIntents lists the cached intents and clients.
+func (as *AppService) GetAdminIntents(w http.ResponseWriter, _ *http.Request) {
+	resp := AdminIntentsResponse{
+		Intents: []id.UserID{},
+		Clients: []id.UserID{},
+	}
+	if as.Registration != nil {
+		resp.Bot = as.BotMXID()
+	}
+	as.intentsLock.RLock()
+	for userID := range as.intents {
+		resp.Intents = append(resp.Intents, userID)
+	}
+	as.intentsLock.RUnlock()
+	as.clientsLock.RLock()
+	for userID := range as.clients {
+		resp.Clients = append(resp.Clients, userID)
+	}
+	as.clientsLock.RUnlock()
+	sort.Slice(resp.Intents, func(i, j int) bool { return resp.Intents[i] < resp.Intents[j] })
+	sort.Slice(resp.Clients, func(i, j int) bool { return resp.Clients[i] < resp.Clients[j] })
+	RespondJSON(w, http.StatusOK, &resp)
+}
+
+// GetAdminRoomState dumps the cached state of a room.
+func (as *AppService) GetAdminRoomState(w http.ResponseWriter, r *http.Request) {
+	roomID := id.RoomID(mux.Vars(r)["roomID"])
+	resp := AdminRoomStateResponse{
+		RoomID:      roomID,
+		PowerLevels: as.StateStore.GetPowerLevels(roomID),
+		Typing:      []id.UserID{},
+	}
+	if dumper, ok := as.StateStore.(RoomStateDumper); ok {
+		resp.Members = dumper.DumpRoomMembers(roomID)
+		if typing := dumper.GetTypingUsers(roomID); typing != nil {
+			resp.Typing = typing
+		}
+	}
+	RespondJSON(w, http.StatusOK, &resp)
+}
+
+// PostAdminRefreshRoom fetches the members and power levels of a room from the homeserver into the state store.
+func (as *AppService) PostAdminRefreshRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := id.RoomID(mux.Vars(r)["roomID"])
+	err := as.RefreshRoomState(r.Context(), roomID)
+	if err != nil {
+		as.Log.Warnfln("Failed to refresh state of %s: %v", roomID, err)
+		queryResultError(false, err).Write(w)
+		return
+	}
+	as.GetAdminRoomState(w, r)
+}
+
+// RefreshRoomState replaces the cached members and power levels of a room with the current ones from the homeserver.
+// Typing notifications are cleared, as they can't be fetched.
+func (as *AppService) RefreshRoomState(ctx context.Context, roomID id.RoomID) error {
+	bot := as.BotIntent().WithContext(ctx)
+	members, err := bot.Members(roomID)
+	if err != nil {
+		return err
+	}
+	var powerLevels event.PowerLevelsEventContent
+	err = bot.StateEvent(roomID, event.StatePowerLevels, "", &powerLevels)
+	if err != nil {
+		return err
+	}
+	for _, evt := range members.Chunk {
+		evt.Type.Class = event.StateEventType
+		as.parseContent(evt)
+		as.UpdateState(evt)
+	}
+	as.StateStore.SetPowerLevels(roomID, &powerLevels)
+	as.setTypingUsers(roomID, nil, 0)
+	return nil
+}
+
+// GetAdminQueue shows the event queue depth.
+func (as *AppService) GetAdminQueue(w http.ResponseWriter, _ *http.Request) {
+	stats := as.QueueStats()
+	RespondJSON(w, http.StatusOK, &stats)
+}
+
+// GetAdminHandlers lists the handlers registered in the running event processors.
+func (as *AppService) GetAdminHandlers(w http.ResponseWriter, _ *http.Request) {
+	resp := AdminHandlersResponse{Processors: []AdminProcessorInfo{}}
+	for _, ep := range as.processors.list() {
+		var poolStats *PoolStats
+		if ep.ExecMode == WorkerPool {
+			stats := ep.PoolStats()
+			poolStats = &stats
+		}
+		info := ep.handlerInfo()
+		info.Pool = poolStats
+		resp.Processors = append(resp.Processors, info)
+	}
+	RespondJSON(w, http.StatusOK, &resp)
+}
+
+// AdminDeadLettersResponse is the response body of the admin dead letter list endpoint.
+type AdminDeadLettersResponse struct {
+	DeadLetters []*DeadLetter `json:"dead_letters"`
+}
+
+func writeDeadLetterError(w http.ResponseWriter, err error) {
+	if err == ErrDeadLetterNotFound {
+		Error{
+			ErrorCode:  ErrNotFound,
+			HTTPStatus: http.StatusNotFound,
+			Message:    "Dead letter not found.",
+		}.Write(w)
+	} else {
+		Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    err.Error(),
+		}.Write(w)
+	}
+}
+
+// GetAdminDeadLetters lists the events that handlers failed to handle.
+func (as *AppService) GetAdminDeadLetters(w http.ResponseWriter, _ *http.Request) {
+	resp := AdminDeadLettersResponse{DeadLetters: []*DeadLetter{}}
+	if as.DeadLetters != nil {
+		letters, err := as.DeadLetters.List()
+		if err != nil {
+			writeDeadLetterError(w, err)
+			return
+		}
+		resp.DeadLetters = append(resp.DeadLetters, letters...)
+	}
+	RespondJSON(w, http.StatusOK, &resp)
+}
+
+// GetAdminDeadLetter shows a single dead letter.
+func (as *AppService) GetAdminDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if as.DeadLetters == nil {
+		writeDeadLetterError(w, ErrDeadLetterNotFound)
+		return
+	}
+	letter, err := as.DeadLetters.Get(mux.Vars(r)["letterID"])
+	if err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, letter)
+}
+
+// DeleteAdminDeadLetter removes a dead letter without replaying it.
+func (as *AppService) DeleteAdminDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if as.DeadLetters == nil {
+		writeDeadLetterError(w, ErrDeadLetterNotFound)
+		return
+	}
+	err := as.DeadLetters.Remove(mux.Vars(r)["letterID"])
+	if err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	WriteBlankOK(w)
+}
+
+// PostAdminReplayDeadLetter calls the handler of a dead letter again.
+func (as *AppService) PostAdminReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	letterID := mux.Vars(r)["letterID"]
+	err := as.ReplayDeadLetter(r.Context(), letterID)
+	if err != nil {
+		as.Log.Warnfln("Failed to replay dead letter %s: %v", letterID, err)
+		writeDeadLetterError(w, err)
+		return
+	}
+	WriteBlankOK(w)
+}
@@ -7,6 +7,7 @@
 package appservice
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"html/template"
@@ -15,6 +16,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"gopkg.in/yaml.v2"
@@ -31,12 +34,18 @@ var EventChannelSize = 64
 
 // Create a blank appservice instance.
 func Create() *AppService {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &AppService{
+		ctx:        ctx,
+		cancel:     cancel,
 		LogConfig:  CreateLogConfig(),
 		clients:    make(map[id.UserID]*mautrix.Client),
 		intents:    make(map[id.UserID]*IntentAPI),
 		StateStore: NewBasicStateStore(),
 		Router:     mux.NewRouter(),
+
+		TransactionStore: NewMemoryTransactionStore(DefaultTransactionRetention),
+		DeadLetters:      NewMemoryDeadLetterStore(DefaultDeadLetterLimit),
 	}
 }
 
@@ -48,6 +57,7 @@ func Load(path string) (*AppService, error) {
 	}
 
 	config := Create()
+	config.configPath = path
 	return config, yaml.Unmarshal(data, config)
 }
 
@@ -67,6 +77,37 @@ func (qh *QueryHandlerStub) QueryUser(userID id.UserID) bool {
 	return false
 }
 
+// ThirdPartyHandler handles third party protocol lookups from the homeserver.
+type ThirdPartyHandler interface {
+	GetProtocol(protocol string) *ThirdPartyProtocol
+	QueryLocation(query ThirdPartyQuery) []*ThirdPartyLocation
+	QueryUser(query ThirdPartyQuery) []*ThirdPartyUser
+	ReverseQueryLocation(alias id.RoomAlias) []*ThirdPartyLocation
+	ReverseQueryUser(userID id.UserID) []*ThirdPartyUser
+}
+
+type ThirdPartyHandlerStub struct{}
+
+func (tph *ThirdPartyHandlerStub) GetProtocol(protocol string) *ThirdPartyProtocol {
+	return nil
+}
+
+func (tph *ThirdPartyHandlerStub) QueryLocation(query ThirdPartyQuery) []*ThirdPartyLocation {
+	return nil
+}
+
+func (tph *ThirdPartyHandlerStub) QueryUser(query ThirdPartyQuery) []*ThirdPartyUser {
+	return nil
+}
+
+func (tph *ThirdPartyHandlerStub) ReverseQueryLocation(alias id.RoomAlias) []*ThirdPartyLocation {
+	return nil
+}
+
+func (tph *ThirdPartyHandlerStub) ReverseQueryUser(userID id.UserID) []*ThirdPartyUser {
+	return nil
+}
+
 // AppService is the main config for all appservices.
 // It also serves as the appservice instance struct.
 type AppService struct {
@@ -80,22 +121,71 @@ type AppService struct {
 		FilterID  string `yaml:"filter_id"`
 		NextBatch string `yaml:"next_batch"`
 	} `yaml:"sync"`
+	Websocket struct {
+		Enabled bool   `yaml:"enabled"`
+		URL     string `yaml:"url"`
+	} `yaml:"websocket"`
+	Provisioning ProvisioningConfig `yaml:"provisioning"`
+	// AdminToken is the access token for the admin API. The admin API is disabled if the token is empty.
+	AdminToken string `yaml:"admin_token,omitempty"`
+	// MetricsToken is the access token for the /metrics endpoint. Metrics aren't served if the token is empty.
+	MetricsToken string `yaml:"metrics_token,omitempty"`
 
 	Registration *Registration    `yaml:"-"`
 	Log          maulogger.Logger `yaml:"-"`
 
-	lastProcessedTransaction string
-
-	Events       chan *event.Event `yaml:"-"`
-	QueryHandler QueryHandler      `yaml:"-"`
-	StateStore   StateStore        `yaml:"-"`
-
-	Router    *mux.Router `yaml:"-"`
-	server    *http.Server
-	botClient *mautrix.Client
-	botIntent *IntentAPI
-	clients   map[id.UserID]*mautrix.Client
-	intents   map[id.UserID]*IntentAPI
+	Events            chan *event.Event `yaml:"-"`
+	ToDeviceEvents    chan *event.Event `yaml:"-"`
+	QueryHandler      QueryHandler      `yaml:"-"`
+	ThirdPartyHandler ThirdPartyHandler `yaml:"-"`
+	StateStore        StateStore        `yaml:"-"`
+	TransactionStore  TransactionStore  `yaml:"-"`
+	// Journal is an optional write-ahead journal for received transactions.
+	// If set, transactions are written to it before they're acknowledged and unfinished events are replayed on Start.
+	Journal TransactionJournal `yaml:"-"`
+	// Metrics is an optional metrics collector. If set, the metrics are served at /metrics to requests that have
+	// the MetricsToken.
+	// It must be set before any clients or intents are created for outgoing requests to be tracked.
+	Metrics *Metrics `yaml:"-"`
+	// Recorder is an optional recorder that writes the raw body of every received transaction into a file.
+	Recorder *TransactionRecorder `yaml:"-"`
+	// DeadLetters stores the events that handlers registered with EventProcessor.OnWithRetry failed to handle.
+	DeadLetters DeadLetterStore `yaml:"-"`
+
+	DeviceListHandler DeviceListHandler `yaml:"-"`
+	OTKCountHandler   OTKCountHandler   `yaml:"-"`
+
+	// QueueTimeout is how long a transaction may wait for space in the event channels.
+	// If the events don't fit in time, the transaction is refused so that the homeserver retries it later.
+	// Zero means transactions wait for as long as it takes.
+	QueueTimeout time.Duration `yaml:"-"`
+	queueLock    sync.Mutex
+	queueStats   QueueStats
+	statsLock    sync.Mutex
+
+	inFlightTxns     map[string]struct{}
+	inFlightTxnsLock sync.Mutex
+
+	healthChecks      healthChecks
+	txnHooks          transactionHooks
+	evtContexts       eventContexts
+	deviceTargets     toDeviceTargets
+	eventHolds        eventHolds
+	ctx               context.Context
+	cancel            context.CancelFunc
+	runningProcessors int32
+	processors        eventProcessors
+
+	Router      *mux.Router `yaml:"-"`
+	configPath  string
+	saveLock    sync.Mutex
+	server      *http.Server
+	botClient   *mautrix.Client
+	botIntent   *IntentAPI
+	clients     map[id.UserID]*mautrix.Client
+	clientsLock sync.RWMutex
+	intents     map[id.UserID]*IntentAPI
+	intentsLock sync.RWMutex
 }
 
 // HostConfig contains info about how to host the appservice.
@@ -104,6 +194,13 @@ type HostConfig struct {
 	Port     uint16 `yaml:"port"`
 	TLSKey   string `yaml:"tls_key,omitempty"`
 	TLSCert  string `yaml:"tls_cert,omitempty"`
+
+	// TLSClientCA is a CA bundle for verifying client certificates. If set, requests from the homeserver
+	// must be made with a certificate signed by one of the CAs. Other endpoints don't require a certificate.
+	TLSClientCA string `yaml:"tls_client_ca,omitempty"`
+	// TLSAllowedSubjects limits the accepted client certificates to the ones whose common name,
+	// DNS name or full subject is in the list. If empty, all certificates signed by the CA are accepted.
+	TLSAllowedSubjects []string `yaml:"tls_allowed_subjects,omitempty"`
 }
 
 // Address gets the whole address of the Appservice.
@@ -113,6 +210,12 @@ func (hc *HostConfig) Address() string {
 
 // Save saves this config into a file at the given path.
 func (as *AppService) Save(path string) error {
+	as.saveLock.Lock()
+	defer as.saveLock.Unlock()
+	return as.save(path)
+}
+
+func (as *AppService) save(path string) error {
 	data, err := yaml.Marshal(as)
 	if err != nil {
 		return err
@@ -122,7 +225,9 @@ func (as *AppService) Save(path string) error {
 
 // YAML returns the config in YAML format.
 func (as *AppService) YAML() (string, error) {
+	as.saveLock.Lock()
 	data, err := yaml.Marshal(as)
+	as.saveLock.Unlock()
 	if err != nil {
 		return "", err
 	}
@@ -134,6 +239,8 @@ func (as *AppService) BotMXID() id.UserID {
 }
 
 func (as *AppService) Intent(userID id.UserID) *IntentAPI {
+	as.intentsLock.Lock()
+	defer as.intentsLock.Unlock()
 	intent, ok := as.intents[userID]
 	if !ok {
 		localpart, homeserver, err := userID.Parse()
@@ -147,6 +254,8 @@ func (as *AppService) Intent(userID id.UserID) *IntentAPI {
 }
 
 func (as *AppService) BotIntent() *IntentAPI {
+	as.intentsLock.Lock()
+	defer as.intentsLock.Unlock()
 	if as.botIntent == nil {
 		as.botIntent = as.NewIntentAPI(as.Registration.SenderLocalpart)
 		as.botIntent.Logger = as.Log.Sub(string(as.botIntent.UserID))
@@ -155,6 +264,8 @@ func (as *AppService) BotIntent() *IntentAPI {
 }
 
 func (as *AppService) Client(userID id.UserID) *mautrix.Client {
+	as.clientsLock.Lock()
+	defer as.clientsLock.Unlock()
 	client, ok := as.clients[userID]
 	if !ok {
 		var err error
@@ -165,6 +276,7 @@ func (as *AppService) Client(userID id.UserID) *mautrix.Client {
 		}
 		client.Syncer = nil
 		client.Store = nil
+		client.Client = as.Metrics.WrapClient(client.Client)
 		client.AppServiceUserID = userID
 		client.Logger = as.Log.Sub(string(userID))
 		as.clients[userID] = client
@@ -173,6 +285,8 @@ func (as *AppService) Client(userID id.UserID) *mautrix.Client {
 }
 
 func (as *AppService) BotClient() *mautrix.Client {
+	as.clientsLock.Lock()
+	defer as.clientsLock.Unlock()
 	if as.botClient == nil {
 		var err error
 		as.botClient, err = mautrix.NewClient(as.HomeserverURL, as.BotMXID(), as.Registration.AppToken)
@@ -182,6 +296,7 @@ func (as *AppService) BotClient() *mautrix.Client {
 		}
 		as.botClient.Syncer = nil
 		as.botClient.Store = nil
+		as.botClient.Client = as.Metrics.WrapClient(as.botClient.Client)
 		as.botClient.Logger = as.Log.Sub("Bot")
 	}
 	return as.botClient
@@ -190,7 +305,9 @@ func (as *AppService) BotClient() *mautrix.Client {
 // Init initializes the logger and loads the registration of this appservice.
 func (as *AppService) Init() (bool, error) {
 	as.Events = make(chan *event.Event, EventChannelSize)
+	as.ToDeviceEvents = make(chan *event.Event, EventChannelSize)
 	as.QueryHandler = &QueryHandlerStub{}
+	as.ThirdPartyHandler = &ThirdPartyHandlerStub{}
 
 	as.Log = maulogger.Create()
 	as.LogConfig.Configure(as.Log)
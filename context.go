@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// valueContext is a context that takes its values from one context and its cancellation from another.
+//
+// It's used to pass the values of a transaction request to event handlers without cancelling the handlers
+// as soon as the transaction has been acknowledged.
+type valueContext struct {
+	context.Context
+	values context.Context
+}
+
+func (vc valueContext) Value(key interface{}) interface{} {
+	if val := vc.values.Value(key); val != nil {
+		return val
+	}
+	return vc.Context.Value(key)
+}
+
+type eventContexts struct {
+	contexts map[*event.Event]context.Context
+	lock     sync.Mutex
+}
+
+// Context returns a context that is cancelled when the appservice is stopped.
+func (as *AppService) Context() context.Context {
+	if as.ctx == nil {
+		return context.Background()
+	}
+	return as.ctx
+}
+
+// trackEventContexts remembers the context that should be passed to the handlers of the given events.
+// Contexts are only tracked while an EventProcessor is running, as nothing else would forget them.
+func (as *AppService) trackEventContexts(reqCtx context.Context, events []*event.Event) {
+	if atomic.LoadInt32(&as.runningProcessors) == 0 || len(events) == 0 {
+		return
+	}
+	ctx := valueContext{Context: as.Context(), values: reqCtx}
+	as.evtContexts.lock.Lock()
+	defer as.evtContexts.lock.Unlock()
+	if as.evtContexts.contexts == nil {
+		as.evtContexts.contexts = make(map[*event.Event]context.Context)
+	}
+	for _, evt := range events {
+		as.evtContexts.contexts[evt] = ctx
+	}
+}
+
+func (as *AppService) forgetEventContexts(events []*event.Event) {
+	as.evtContexts.lock.Lock()
+	defer as.evtContexts.lock.Unlock()
+	for _, evt := range events {
+		delete(as.evtContexts.contexts, evt)
+	}
+}
+
+// eventContext returns the context for the handlers of the given event.
+func (as *AppService) eventContext(evt *event.Event) context.Context {
+	as.evtContexts.lock.Lock()
+	ctx, ok := as.evtContexts.contexts[evt]
+	as.evtContexts.lock.Unlock()
+	if !ok {
+		return as.Context()
+	}
+	return ctx
+}
@@ -7,12 +7,17 @@
 package appservice
 
 import (
+	"context"
 	"encoding/json"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "maunium.net/go/maulogger/v2"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 type ExecMode uint8
@@ -21,81 +26,342 @@ const (
 	AsyncHandlers ExecMode = iota
 	AsyncLoop
 	Sync
+	// RoomOrdered handles the events of each room in order in a worker goroutine for the room.
+	// Different rooms are handled in parallel, and workers exit after being idle for RoomWorkerIdleTimeout.
+	RoomOrdered
+	// WorkerPool handles events in a fixed number of worker goroutines fed by a bounded queue.
+	// The handlers of one event are called in order by one worker. See PoolConfig for the settings.
+	WorkerPool
 )
 
+// RoomWorkerIdleTimeout is how long a room worker in the RoomOrdered mode waits for new events before exiting.
+var RoomWorkerIdleTimeout = 30 * time.Second
+
+// RoomQueueSize is the number of events that can wait for a room worker in the RoomOrdered mode.
+// If the queue of a room is full, dispatching events blocks until the worker catches up.
+var RoomQueueSize = 64
+
+// EventHandler is an event handler that also receives a context for the event.
+//
+// The context has the values of the request context of the transaction the event came in,
+// and it's cancelled when the appservice is stopped.
+type EventHandler func(ctx context.Context, evt *event.Event)
+
 type EventProcessor struct {
 	ExecMode ExecMode
+	// Pool contains the settings of the WorkerPool mode. It must be set before the first event is dispatched.
+	Pool PoolConfig
 
 	as       *AppService
 	log      log.Logger
 	stop     chan struct{}
-	handlers map[event.Type][]mautrix.OnEventListener
+	handlers map[event.Type][]EventHandler
+
+	toDeviceHandlers  map[event.Type][]EventHandler
+	catchAllHandlers  []EventHandler
+	classHandlers     map[event.TypeClass][]EventHandler
+	unhandledHandlers []EventHandler
+	handlersLock      sync.RWMutex
+
+	roomQueues map[id.RoomID]*roomQueue
+	roomLock   sync.Mutex
+
+	pool     *workerPool
+	poolLock sync.Mutex
+
+	middlewares []Middleware
+
+	retryHandlers map[string]*retryHandler
+	retryLock     sync.RWMutex
+}
+
+type pendingEvent struct {
+	ctx      context.Context
+	handlers []EventHandler
+	evt      *event.Event
+}
+
+type roomQueue struct {
+	events chan pendingEvent
+	// senders is the number of events that are about to be sent to the queue. It's only incremented while holding
+	// the room lock, so the worker can't exit while there are senders.
+	senders int32
 }
 
 func NewEventProcessor(as *AppService) *EventProcessor {
 	return &EventProcessor{
 		ExecMode: AsyncHandlers,
+		Pool:     DefaultPoolConfig,
 		as:       as,
 		log:      as.Log.Sub("Events"),
 		stop:     make(chan struct{}, 1),
-		handlers: make(map[event.Type][]mautrix.OnEventListener),
+		handlers: make(map[event.Type][]EventHandler),
+
+		toDeviceHandlers: make(map[event.Type][]EventHandler),
+		classHandlers:    make(map[event.TypeClass][]EventHandler),
+
+		roomQueues: make(map[id.RoomID]*roomQueue),
+
+		retryHandlers: make(map[string]*retryHandler),
+	}
+}
+
+func withoutContext(handler mautrix.OnEventListener) EventHandler {
+	return func(_ context.Context, evt *event.Event) {
+		handler(evt)
 	}
 }
 
 func (ep *EventProcessor) On(evtType event.Type, handler mautrix.OnEventListener) {
+	ep.OnContext(evtType, withoutContext(handler))
+}
+
+// OnContext registers a handler that receives the context of the event in addition to the event itself.
+func (ep *EventProcessor) OnContext(evtType event.Type, handler EventHandler) {
+	ep.handlersLock.Lock()
+	defer ep.handlersLock.Unlock()
 	handlers, ok := ep.handlers[evtType]
 	if !ok {
-		handlers = []mautrix.OnEventListener{handler}
+		handlers = []EventHandler{handler}
 	} else {
 		handlers = append(handlers, handler)
 	}
 	ep.handlers[evtType] = handlers
 }
 
-func (ep *EventProcessor) callHandler(handler mautrix.OnEventListener, evt *event.Event) {
+// OnToDevice registers a handler for to-device events of the given type pushed by the homeserver (MSC2409).
+func (ep *EventProcessor) OnToDevice(evtType event.Type, handler mautrix.OnEventListener) {
+	ep.OnToDeviceContext(evtType, withoutContext(handler))
+}
+
+// OnToDeviceContext registers a to-device event handler that receives the context of the event.
+func (ep *EventProcessor) OnToDeviceContext(evtType event.Type, handler EventHandler) {
+	evtType.Class = event.ToDeviceEventType
+	ep.handlersLock.Lock()
+	defer ep.handlersLock.Unlock()
+	ep.toDeviceHandlers[evtType] = append(ep.toDeviceHandlers[evtType], handler)
+}
+
+// OnAll registers a handler for all events, including to-device events.
+//
+// For each event, the catch-all handlers come first, then the handlers for the class of the event,
+// and finally the handlers for the exact type of the event, or the unhandled event handlers if there
+// are none for the type. Within each group, handlers are in the order they were registered.
+// The order is followed in every ExecMode except AsyncHandlers, which runs all of them concurrently.
+// RoomOrdered and WorkerPool also call the handlers of one event in order, but only RoomOrdered, AsyncLoop
+// and Sync keep the events of a room in order.
+func (ep *EventProcessor) OnAll(handler mautrix.OnEventListener) {
+	ep.OnAllContext(withoutContext(handler))
+}
+
+// OnAllContext registers a catch-all handler that receives the context of the event.
+func (ep *EventProcessor) OnAllContext(handler EventHandler) {
+	ep.handlersLock.Lock()
+	defer ep.handlersLock.Unlock()
+	ep.catchAllHandlers = append(ep.catchAllHandlers, handler)
+}
+
+// OnClass registers a handler for all events of the given class, e.g. event.StateEventType for all state events.
+// See OnAll for the order in which the different kinds of handlers are called.
+func (ep *EventProcessor) OnClass(class event.TypeClass, handler mautrix.OnEventListener) {
+	ep.OnClassContext(class, withoutContext(handler))
+}
+
+// OnClassContext registers a class handler that receives the context of the event.
+func (ep *EventProcessor) OnClassContext(class event.TypeClass, handler EventHandler) {
+	ep.handlersLock.Lock()
+	defer ep.handlersLock.Unlock()
+	ep.classHandlers[class] = append(ep.classHandlers[class], handler)
+}
+
+// OnUnhandled registers a fallback handler for events whose type has no handlers registered with On or OnToDevice.
+// Catch-all and class handlers don't count as handling the event.
+// See OnAll for the order in which the different kinds of handlers are called.
+func (ep *EventProcessor) OnUnhandled(handler mautrix.OnEventListener) {
+	ep.OnUnhandledContext(withoutContext(handler))
+}
+
+// OnUnhandledContext registers a fallback handler that receives the context of the event.
+func (ep *EventProcessor) OnUnhandledContext(handler EventHandler) {
+	ep.handlersLock.Lock()
+	defer ep.handlersLock.Unlock()
+	ep.unhandledHandlers = append(ep.unhandledHandlers, handler)
+}
+
+// handlersFor collects the catch-all, class and type-specific or fallback handlers for the given event in order.
+// The caller must hold the read lock of handlersLock.
+func (ep *EventProcessor) handlersFor(typeHandlers []EventHandler, evt *event.Event) []EventHandler {
+	classHandlers := ep.classHandlers[evt.Type.Class]
+	if len(typeHandlers) == 0 {
+		typeHandlers = ep.unhandledHandlers
+	}
+	if len(ep.catchAllHandlers) == 0 && len(classHandlers) == 0 {
+		return typeHandlers
+	}
+	handlers := make([]EventHandler, 0, len(ep.catchAllHandlers)+len(classHandlers)+len(typeHandlers))
+	handlers = append(handlers, ep.catchAllHandlers...)
+	handlers = append(handlers, classHandlers...)
+	return append(handlers, typeHandlers...)
+}
+
+// addMetricsEventTypes gives the event types that have handlers their own label in the metrics.
+func (ep *EventProcessor) addMetricsEventTypes() {
+	ep.handlersLock.RLock()
+	defer ep.handlersLock.RUnlock()
+	for evtType := range ep.handlers {
+		ep.as.Metrics.AddEventTypes(evtType)
+	}
+	for evtType := range ep.toDeviceHandlers {
+		ep.as.Metrics.AddEventTypes(evtType)
+	}
+}
+
+// callHandler calls the given handler through the middleware chain. Panics that aren't handled by a middleware
+// are recovered and logged here, so that a broken handler can't crash the appservice.
+func (ep *EventProcessor) callHandler(ctx context.Context, handler EventHandler, evt *event.Event) {
+	start := time.Now()
 	defer func() {
-		if err := recover(); err != nil {
-			d, _ := json.Marshal(evt)
-			ep.log.Errorfln("Panic in Matrix event handler: %v (event content: %s):\n%s", err, string(d), string(debug.Stack()))
+		err := recover()
+		if err != nil {
+			logPanic(ep.log, err, evt)
 		}
+		ep.as.Metrics.TrackHandler(evt.Type.Type, time.Since(start), err != nil)
 	}()
-	handler(evt)
+	ep.wrap(handler)(ctx, evt)
 }
 
+func logPanic(logger log.Logger, err interface{}, evt *event.Event) {
+	d, _ := json.Marshal(evt)
+	logger.Errorfln("Panic in Matrix event handler: %v (event content: %s):\n%s", err, string(d), string(debug.Stack()))
+}
+
+// Dispatch calls the handlers for the given event. See OnAll for the order of the handlers.
 func (ep *EventProcessor) Dispatch(evt *event.Event) {
-	handlers, ok := ep.handlers[evt.Type]
-	if !ok {
+	ep.handlersLock.RLock()
+	handlers := ep.handlersFor(ep.handlers[evt.Type], evt)
+	ep.handlersLock.RUnlock()
+	ep.runHandlers(ep.as.eventContext(evt), handlers, evt)
+}
+
+// DispatchToDevice calls the handlers registered with OnToDevice for the given to-device event,
+// as well as the catch-all, class and fallback handlers.
+func (ep *EventProcessor) DispatchToDevice(evt *event.Event) {
+	ep.handlersLock.RLock()
+	handlers := ep.handlersFor(ep.toDeviceHandlers[evt.Type], evt)
+	ep.handlersLock.RUnlock()
+	ep.runHandlers(ep.as.eventContext(evt), handlers, evt)
+}
+
+// runHandlers calls the given handlers according to the ExecMode and marks the event as done in the
+// transaction journal and transaction hooks once all of them have returned.
+func (ep *EventProcessor) runHandlers(ctx context.Context, handlers []EventHandler, evt *event.Event) {
+	if len(handlers) == 0 {
+		ep.as.markEventDone(evt)
 		return
 	}
 	switch ep.ExecMode {
 	case AsyncHandlers:
+		var wg sync.WaitGroup
+		wg.Add(len(handlers))
 		for _, handler := range handlers {
-			go ep.callHandler(handler, evt)
+			go func(handler EventHandler) {
+				defer wg.Done()
+				ep.callHandler(ctx, handler, evt)
+			}(handler)
 		}
+		go func() {
+			wg.Wait()
+			ep.as.markEventDone(evt)
+		}()
 	case AsyncLoop:
 		go func() {
 			for _, handler := range handlers {
-				ep.callHandler(handler, evt)
+				ep.callHandler(ctx, handler, evt)
 			}
+			ep.as.markEventDone(evt)
 		}()
 	case Sync:
 		for _, handler := range handlers {
-			ep.callHandler(handler, evt)
+			ep.callHandler(ctx, handler, evt)
+		}
+		ep.as.markEventDone(evt)
+	case RoomOrdered:
+		ep.queueRoomEvent(pendingEvent{ctx, handlers, evt})
+	case WorkerPool:
+		ep.queuePoolEvent(pendingEvent{ctx, handlers, evt})
+	}
+}
+
+// runPending calls the handlers of a queued event in order and marks the event as done.
+func (ep *EventProcessor) runPending(pe pendingEvent) {
+	for _, handler := range pe.handlers {
+		ep.callHandler(pe.ctx, handler, pe.evt)
+	}
+	ep.as.markEventDone(pe.evt)
+}
+
+// queueRoomEvent passes an event to the worker of its room, starting a new worker if there isn't one.
+// Events without a room, like to-device events, share a worker.
+func (ep *EventProcessor) queueRoomEvent(pe pendingEvent) {
+	ep.roomLock.Lock()
+	queue, ok := ep.roomQueues[pe.evt.RoomID]
+	if !ok {
+		queue = &roomQueue{events: make(chan pendingEvent, RoomQueueSize)}
+		ep.roomQueues[pe.evt.RoomID] = queue
+		go ep.roomWorker(pe.evt.RoomID, queue)
+	}
+	atomic.AddInt32(&queue.senders, 1)
+	ep.roomLock.Unlock()
+	// The lock isn't held while sending, so that a full queue only blocks its own room.
+	queue.events <- pe
+	atomic.AddInt32(&queue.senders, -1)
+}
+
+func (ep *EventProcessor) roomWorker(roomID id.RoomID, queue *roomQueue) {
+	idleTimer := time.NewTimer(RoomWorkerIdleTimeout)
+	defer idleTimer.Stop()
+	for {
+		select {
+		case pe := <-queue.events:
+			ep.runPending(pe)
+			if !idleTimer.Stop() {
+				<-idleTimer.C
+			}
+			idleTimer.Reset(RoomWorkerIdleTimeout)
+		case <-idleTimer.C:
+			ep.roomLock.Lock()
+			if len(queue.events) == 0 && atomic.LoadInt32(&queue.senders) == 0 {
+				delete(ep.roomQueues, roomID)
+				ep.roomLock.Unlock()
+				return
+			}
+			ep.roomLock.Unlock()
+			idleTimer.Reset(RoomWorkerIdleTimeout)
 		}
 	}
 }
 
 func (ep *EventProcessor) Start() {
+	ep.addMetricsEventTypes()
+	atomic.AddInt32(&ep.as.runningProcessors, 1)
+	defer atomic.AddInt32(&ep.as.runningProcessors, -1)
+	ep.as.processors.add(ep)
+	defer ep.as.processors.remove(ep)
+	defer ep.stopPool()
 	for {
 		select {
 		case evt := <-ep.as.Events:
 			ep.Dispatch(evt)
+		case evt := <-ep.as.ToDeviceEvents:
+			ep.DispatchToDevice(evt)
 		case <-ep.stop:
 			return
 		}
 	}
 }
 
+// Stop tells the event loop started with Start to stop. In the WorkerPool mode, Start closes the pool queue
+// and waits for the workers to handle the events that are already queued before returning.
 func (ep *EventProcessor) Stop() {
 	ep.stop <- struct{}{}
 }
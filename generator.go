@@ -128,6 +128,17 @@ func GenerateRegistration(asName, botName string, reserveRooms, reserveUsers boo
 	}
 	os.MkdirAll(config.LogConfig.Directory, 0755)
 
+	ephemeralInput, err := readString(reader, "Do you want the homeserver to push ephemeral events (typing, receipts, presence) [yes/no]?", "no")
+	if err != nil {
+		fmt.Println("Failed to read user Input:", err)
+		return
+	}
+	wantEphemeral := strings.ToLower(ephemeralInput)
+	if wantEphemeral == yes || wantEphemeral == yesShort {
+		registration.EphemeralEvents = true
+		registration.SoruEphemeralEvents = true
+	}
+
 	if reserveRooms || reserveUsers {
 		for {
 			namespace, err := readString(reader, "Enter namespace prefix", fmt.Sprintf("_%s_", name))
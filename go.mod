@@ -5,6 +5,7 @@ go 1.14
 require (
 	github.com/fatih/color v1.9.0
 	github.com/gorilla/mux v1.7.4
+	github.com/gorilla/websocket v1.4.2
 	github.com/pkg/errors v0.9.1
 	gopkg.in/yaml.v2 v2.2.8
 	maunium.net/go/maulogger/v2 v2.1.1
@@ -0,0 +1,175 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckTimeout is how long a single readiness check may take before it's considered failed.
+var HealthCheckTimeout = 5 * time.Second
+
+// HomeserverCheckTTL is how long the result of the homeserver readiness check is reused before asking the homeserver again.
+var HomeserverCheckTTL = 10 * time.Second
+
+// QueueSaturationThreshold is the fraction of the Events channel that can be filled before the appservice is considered not ready.
+var QueueSaturationThreshold = 0.9
+
+// HealthCheck is a function that returns an error if some part of the appservice isn't ready.
+type HealthCheck func() error
+
+type namedHealthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// HealthCheckResult is the result of a single check in the /_ready response.
+type HealthCheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ReadinessResponse is the response body of the /_ready endpoint.
+type ReadinessResponse struct {
+	Ready  bool                         `json:"ready"`
+	Checks map[string]HealthCheckResult `json:"checks"`
+}
+
+type healthChecks struct {
+	checks []namedHealthCheck
+	lock   sync.RWMutex
+
+	homeserverErr       error
+	homeserverCheckedAt time.Time
+	homeserverLock      sync.Mutex
+}
+
+// AddHealthCheck registers an extra named check that must pass for the appservice to be considered ready,
+// e.g. the connection to the remote network of a bridge.
+func (as *AppService) AddHealthCheck(name string, check HealthCheck) {
+	as.healthChecks.lock.Lock()
+	defer as.healthChecks.lock.Unlock()
+	as.healthChecks.checks = append(as.healthChecks.checks, namedHealthCheck{name, check})
+}
+
+func (as *AppService) checkRegistration() error {
+	if as.Registration == nil {
+		return errors.New("registration not loaded")
+	}
+	return nil
+}
+
+// checkHomeserver checks that the homeserver accepts the as_token. The result is cached for HomeserverCheckTTL,
+// so that frequent probes don't all call the homeserver.
+func (as *AppService) checkHomeserver() error {
+	if as.Registration == nil {
+		return errors.New("registration not loaded")
+	}
+	as.healthChecks.homeserverLock.Lock()
+	defer as.healthChecks.homeserverLock.Unlock()
+	if time.Since(as.healthChecks.homeserverCheckedAt) < HomeserverCheckTTL {
+		return as.healthChecks.homeserverErr
+	}
+	err := as.whoamiBot()
+	as.healthChecks.homeserverErr = err
+	as.healthChecks.homeserverCheckedAt = time.Now()
+	return err
+}
+
+func (as *AppService) whoamiBot() error {
+	resp, err := as.BotIntent().Whoami()
+	if err != nil {
+		return err
+	} else if resp.UserID != as.BotMXID() {
+		return fmt.Errorf("whoami returned unexpected user ID %s", resp.UserID)
+	}
+	return nil
+}
+
+func (as *AppService) checkEventProcessor() error {
+	if atomic.LoadInt32(&as.runningProcessors) == 0 {
+		return errors.New("event processor not running")
+	}
+	if cap(as.Events) > 0 && float64(len(as.Events)) >= float64(cap(as.Events))*QueueSaturationThreshold {
+		return fmt.Errorf("event queue saturated (%d/%d)", len(as.Events), cap(as.Events))
+	}
+	return nil
+}
+
+func runHealthCheck(check HealthCheck) HealthCheckResult {
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				result <- fmt.Errorf("check panicked: %v", err)
+			}
+		}()
+		result <- check()
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return HealthCheckResult{OK: false, Error: err.Error()}
+		}
+		return HealthCheckResult{OK: true}
+	case <-time.After(HealthCheckTimeout):
+		return HealthCheckResult{OK: false, Error: "check timed out"}
+	}
+}
+
+// CheckReadiness runs all the readiness checks concurrently.
+func (as *AppService) CheckReadiness() *ReadinessResponse {
+	as.healthChecks.lock.RLock()
+	checks := append([]namedHealthCheck{
+		{"registration", as.checkRegistration},
+		{"homeserver", as.checkHomeserver},
+		{"event_processor", as.checkEventProcessor},
+	}, as.healthChecks.checks...)
+	as.healthChecks.lock.RUnlock()
+
+	resp := &ReadinessResponse{
+		Ready:  true,
+		Checks: make(map[string]HealthCheckResult, len(checks)),
+	}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	wg.Add(len(checks))
+	for _, check := range checks {
+		go func(check namedHealthCheck) {
+			defer wg.Done()
+			result := runHealthCheck(check.check)
+			lock.Lock()
+			resp.Checks[check.name] = result
+			resp.Ready = resp.Ready && result.OK
+			lock.Unlock()
+		}(check)
+	}
+	wg.Wait()
+	return resp
+}
+
+// GetHealth handles a /_health GET call. It succeeds as long as the HTTP server is up.
+func (as *AppService) GetHealth(w http.ResponseWriter, r *http.Request) {
+	WriteBlankOK(w)
+}
+
+// GetReady handles a /_ready GET call.
+func (as *AppService) GetReady(w http.ResponseWriter, r *http.Request) {
+	resp := as.CheckReadiness()
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = Respond(w, resp)
+}
@@ -11,67 +11,131 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 
+	"maunium.net/go/maulogger/v2"
+
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
 // Listen starts the HTTP server that listens for calls from the Matrix homeserver.
 func (as *AppService) Start() {
+	as.server = &http.Server{
+		Addr:    as.Host.Address(),
+		Handler: as.Router,
+	}
+	as.startHosted()
+	as.Log.Infoln("Listening on", as.Host.Address())
+	listen(as.server, &as.Host, as.Log)
+}
+
+// startHosted registers the HTTP handlers and starts the background tasks of the appservice,
+// but doesn't start a listener.
+func (as *AppService) startHosted() {
 	as.Router.HandleFunc("/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
 	as.Router.HandleFunc("/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
 	as.Router.HandleFunc("/users/{userID}", as.GetUser).Methods(http.MethodGet)
 	as.Router.HandleFunc("/_matrix/app/v1/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
 	as.Router.HandleFunc("/_matrix/app/v1/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
 	as.Router.HandleFunc("/_matrix/app/v1/users/{userID}", as.GetUser).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/ping", as.PostPing).Methods(http.MethodPost)
+	as.Router.HandleFunc("/_matrix/app/unstable/fi.mau.msc2659/ping", as.PostPing).Methods(http.MethodPost)
+	as.Router.HandleFunc("/_health", as.GetHealth).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_ready", as.GetReady).Methods(http.MethodGet)
+	if as.Metrics != nil && len(as.MetricsToken) > 0 {
+		as.Router.HandleFunc("/metrics", as.GetMetrics).Methods(http.MethodGet)
+	}
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/protocol/{protocol}", as.GetThirdPartyProtocol).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/location/{protocol}", as.GetThirdPartyLocation).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/user/{protocol}", as.GetThirdPartyUser).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/location", as.GetThirdPartyLocationByAlias).Methods(http.MethodGet)
+	as.Router.HandleFunc("/_matrix/app/v1/thirdparty/user", as.GetThirdPartyUserByID).Methods(http.MethodGet)
+	as.registerAdminAPI()
+
+	as.startJournalReplay()
+	go as.StartSync()
+	go as.StartWebsocket()
+}
 
+// listen runs the given HTTP server with the TLS settings in the given host config until the server is closed.
+func listen(server *http.Server, host *HostConfig, logger maulogger.Logger) {
 	var err error
-	as.server = &http.Server{
-		Addr:    as.Host.Address(),
-		Handler: as.Router,
-	}
-	as.Log.Infoln("Listening on", as.Host.Address())
-	if len(as.Host.TLSCert) == 0 || len(as.Host.TLSKey) == 0 {
-		err = as.server.ListenAndServe()
+	if len(host.TLSCert) == 0 || len(host.TLSKey) == 0 {
+		if len(host.TLSClientCA) > 0 {
+			logger.Fatalln("Client certificate verification requires tls_cert and tls_key to be set")
+			return
+		}
+		err = server.ListenAndServe()
 	} else {
-		err = as.server.ListenAndServeTLS(as.Host.TLSCert, as.Host.TLSKey)
+		var reloader *tlsReloader
+		reloader, err = newTLSReloader(host, logger.Sub("TLS"))
+		if err != nil {
+			logger.Fatalln("Failed to load TLS certificates:", err)
+			return
+		}
+		if len(host.TLSClientCA) > 0 {
+			server.Handler = requireClientCerts(server.Handler, host)
+		}
+		server.TLSConfig = reloader.base
+		stopWatching := make(chan struct{})
+		go reloader.watch(stopWatching)
+		err = server.ListenAndServeTLS("", "")
+		close(stopWatching)
 	}
 	if err != nil && err.Error() != "http: Server closed" {
-		as.Log.Fatalln("Error while listening:", err)
+		logger.Fatalln("Error while listening:", err)
 	} else {
-		as.Log.Debugln("Listener stopped.")
+		logger.Debugln("Listener stopped.")
 	}
 }
 
 func (as *AppService) Stop() {
+	if as.cancel != nil {
+		as.cancel()
+	}
 	if as.server == nil {
 		return
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	_ = as.server.Shutdown(ctx)
 	as.server = nil
 }
 
 // CheckServerToken checks if the given request originated from the Matrix homeserver.
 func (as *AppService) CheckServerToken(w http.ResponseWriter, r *http.Request) bool {
-	query := r.URL.Query()
-	val, ok := query["access_token"]
-	if !ok {
+	token := requestToken(r)
+	if len(token) == 0 || token != as.Registration.ServerToken {
 		Error{
 			ErrorCode:  ErrForbidden,
 			HTTPStatus: http.StatusForbidden,
 			Message:    "Bad token supplied.",
 		}.Write(w)
 		return false
+	} else if err := checkClientCert(r); err != nil {
+		as.Log.Debugfln("Rejecting %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		Error{
+			ErrorCode:  ErrForbidden,
+			HTTPStatus: http.StatusForbidden,
+			Message:    "Valid client certificate required.",
+		}.Write(w)
+		return false
 	}
-	for _, str := range val {
-		return str == as.Registration.ServerToken
+	return true
+}
+
+// requestToken gets the access token of the given request from the query parameters or the Authorization header.
+func requestToken(r *http.Request) string {
+	token := r.URL.Query().Get("access_token")
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		token = strings.TrimPrefix(authHeader, "Bearer ")
 	}
-	return false
+	return token
 }
 
 // PutTransaction handles a /transactions PUT call from the homeserver.
@@ -100,38 +164,207 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 		}.Write(w)
 		return
 	}
-	if as.lastProcessedTransaction == txnID {
-		// Duplicate transaction ID: no-op
+	if respErr := as.handleTransaction(r.Context(), txnID, body); respErr != nil {
+		if respErr.HTTPStatus == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+		}
+		respErr.Write(w)
+	} else {
 		WriteBlankOK(w)
-		return
 	}
+}
 
+// handleTransaction processes the body of a transaction from the homeserver.
+// It returns the error that should be sent to the homeserver, or nil if the transaction was accepted.
+func (as *AppService) handleTransaction(ctx context.Context, txnID string, body []byte) *Error {
+	err := as.Recorder.Record(txnID, body)
+	if err != nil {
+		as.Log.Warnfln("Failed to record transaction %s: %v", txnID, err)
+	}
 	eventList := EventList{}
 	err = json.Unmarshal(body, &eventList)
 	if err != nil {
 		as.Log.Warnfln("Failed to parse JSON of transaction %s: %v", txnID, err)
-		Error{
+		return &Error{
 			ErrorCode:  ErrInvalidJSON,
 			HTTPStatus: http.StatusBadRequest,
 			Message:    "Failed to parse body JSON.",
-		}.Write(w)
-	} else {
-		for _, evt := range eventList.Events {
-			if evt.StateKey != nil {
-				evt.Type.Class = event.StateEventType
-			} else {
-				evt.Type.Class = event.MessageEventType
+		}
+	}
+	return as.processTransaction(ctx, txnID, &eventList)
+}
+
+// processTransaction deduplicates, journals and dispatches the events of a transaction, and waits for the
+// transaction hooks. It's used for both pushed transactions and sync batches.
+func (as *AppService) processTransaction(ctx context.Context, txnID string, eventList *EventList) *Error {
+	if !as.claimTransaction(txnID) {
+		as.Log.Debugfln("Transaction %s is still being handled, asking the homeserver to retry later", txnID)
+		return &Error{
+			ErrorCode:  ErrTransactionInProgress,
+			HTTPStatus: http.StatusServiceUnavailable,
+			Message:    "Transaction is still being handled, try again later.",
+		}
+	}
+	releaseLater := false
+	defer func() {
+		if !releaseLater {
+			as.releaseTransaction(txnID)
+		}
+	}()
+	processed, err := as.TransactionStore.IsProcessed(txnID)
+	if err != nil {
+		as.Log.Errorfln("Failed to check if transaction %s was already processed: %v", txnID, err)
+		return &Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    "Failed to check if transaction was already processed.",
+		}
+	} else if processed {
+		// Duplicate transaction ID: no-op
+		return nil
+	}
+	as.Metrics.TrackTransaction()
+	as.prepareEvents(eventList.Events, event.UnknownEventType)
+	as.prepareEvents(eventList.EphemeralEvents(), event.EphemeralEventType)
+	as.prepareEvents(eventList.ToDeviceEvents(), event.ToDeviceEventType)
+	txn, err := as.startTransaction(ctx, txnID, eventList)
+	if err != nil {
+		as.Log.Warnfln("Transaction start hook failed for %s: %v", txnID, err)
+		return &Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    err.Error(),
+		}
+	}
+	if as.Journal != nil {
+		err = as.Journal.Write(txnID, eventList.allEvents())
+		if err == ErrTransactionPending {
+			as.forgetTransaction(txn)
+			as.Log.Debugfln("Transaction %s is still being handled, asking the homeserver to retry later", txnID)
+			return &Error{
+				ErrorCode:  ErrTransactionInProgress,
+				HTTPStatus: http.StatusServiceUnavailable,
+				Message:    "Transaction is still being handled, try again later.",
+			}
+		} else if err != nil {
+			as.forgetTransaction(txn)
+			as.Log.Errorfln("Failed to write transaction %s to journal: %v", txnID, err)
+			return &Error{
+				ErrorCode:  ErrUnknown,
+				HTTPStatus: http.StatusInternalServerError,
+				Message:    "Failed to write transaction to journal.",
 			}
-			err := evt.Content.ParseRaw(evt.Type)
+		}
+	}
+	as.trackEventContexts(ctx, eventList.allEvents())
+	as.trackToDeviceTargets(eventList)
+	if !as.queueTransaction(eventList) {
+		as.Log.Warnfln("Refusing transaction %s: event queue is full", txnID)
+		as.forgetTransaction(txn)
+		as.forgetEventContexts(eventList.allEvents())
+		as.forgetToDeviceTargets(eventList.allEvents())
+		if as.Journal != nil {
+			err = as.Journal.Discard(txnID)
 			if err != nil {
-				as.Log.Debugfln("Failed to parse content of %s: %v", evt.ID, err)
+				as.Log.Warnfln("Failed to discard refused transaction %s from journal: %v", txnID, err)
 			}
-			as.UpdateState(evt)
-			as.Events <- evt
 		}
-		WriteBlankOK(w)
+		return &Error{
+			ErrorCode:  ErrQueueFull,
+			HTTPStatus: http.StatusServiceUnavailable,
+			Message:    "Event queue is full, try again later.",
+		}
+	}
+	as.handleDeviceLists(eventList.DeviceListChanges())
+	as.handleOTKCounts(eventList.OTKCounts())
+	select {
+	case <-txn.done:
+	case <-ctx.Done():
+		// The homeserver stopped waiting, but the end hooks still decide whether the transaction counts as
+		// processed, so keep it claimed until they return.
+		releaseLater = true
+		go func() {
+			<-txn.done
+			as.finishTransaction(txn)
+			as.releaseTransaction(txnID)
+		}()
+		return nil
 	}
-	as.lastProcessedTransaction = txnID
+	return as.finishTransaction(txn)
+}
+
+// finishTransaction marks a transaction as processed after its end hooks have returned,
+// unless one of them failed, in which case the homeserver should retry it.
+func (as *AppService) finishTransaction(txn *Transaction) *Error {
+	if txn.endErr != nil {
+		as.Log.Warnfln("Transaction end hook failed for %s: %v", txn.ID, txn.endErr)
+		return &Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    txn.endErr.Error(),
+		}
+	}
+	err := as.TransactionStore.MarkProcessed(txn.ID)
+	if err != nil {
+		as.Log.Warnfln("Failed to mark transaction %s as processed: %v", txn.ID, err)
+	}
+	return nil
+}
+
+// claimTransaction marks the transaction as being handled. It returns false if it's already being handled,
+// i.e. the homeserver retried it before the first attempt finished.
+func (as *AppService) claimTransaction(txnID string) bool {
+	as.inFlightTxnsLock.Lock()
+	defer as.inFlightTxnsLock.Unlock()
+	if _, ok := as.inFlightTxns[txnID]; ok {
+		return false
+	} else if as.inFlightTxns == nil {
+		as.inFlightTxns = make(map[string]struct{})
+	}
+	as.inFlightTxns[txnID] = struct{}{}
+	return true
+}
+
+func (as *AppService) releaseTransaction(txnID string) {
+	as.inFlightTxnsLock.Lock()
+	delete(as.inFlightTxns, txnID)
+	as.inFlightTxnsLock.Unlock()
+}
+
+func (as *AppService) prepareEvents(evts []*event.Event, defaultTypeClass event.TypeClass) {
+	for _, evt := range evts {
+		if defaultTypeClass != event.UnknownEventType {
+			evt.Type.Class = defaultTypeClass
+		} else if evt.StateKey != nil {
+			evt.Type.Class = event.StateEventType
+		} else {
+			evt.Type.Class = event.MessageEventType
+		}
+		as.Metrics.TrackEvent(evt.Type.Type)
+		as.parseContent(evt)
+	}
+}
+
+func (as *AppService) parseContent(evt *event.Event) {
+	err := evt.Content.ParseRaw(evt.Type)
+	if err != nil {
+		as.Log.Debugfln("Failed to parse content of %s: %v", evt.ID, err)
+		as.Metrics.TrackParseFailure(evt.Type.Type)
+	}
+}
+
+func (as *AppService) handleDeviceLists(lists *DeviceLists) {
+	if lists == nil || as.DeviceListHandler == nil {
+		return
+	}
+	as.DeviceListHandler(lists)
+}
+
+func (as *AppService) handleOTKCounts(otkCounts OTKCountMap) {
+	if len(otkCounts) == 0 || as.OTKCountHandler == nil {
+		return
+	}
+	as.OTKCountHandler(otkCounts)
 }
 
 // GetRoom handles a /rooms GET call from the homeserver.
@@ -141,15 +374,27 @@ func (as *AppService) GetRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	vars := mux.Vars(r)
-	roomAlias := vars["roomAlias"]
-	ok := as.QueryHandler.QueryAlias(roomAlias)
-	if ok {
-		WriteBlankOK(w)
-	} else {
-		Error{
-			ErrorCode:  ErrUnknown,
-			HTTPStatus: http.StatusNotFound,
-		}.Write(w)
+	writeQueryResult(w, as.handleAliasQuery(r.Context(), vars["roomAlias"]))
+}
+
+// handleAliasQuery answers a room alias query from the homeserver.
+// It returns the error that should be sent to the homeserver, or nil if the alias exists.
+func (as *AppService) handleAliasQuery(ctx context.Context, roomAlias string) *Error {
+	if handler, ok := as.QueryHandler.(AliasQueryHandler); ok {
+		ok, err := runWithTimeout(ctx, func(ctx context.Context) (bool, error) {
+			return as.provisionAlias(ctx, handler, id.RoomAlias(roomAlias))
+		})
+		if err != nil {
+			as.Log.Warnfln("Failed to provision room for alias %s: %v", roomAlias, err)
+		}
+		return queryResultError(ok, err)
+	}
+	if as.QueryHandler.QueryAlias(roomAlias) {
+		return nil
+	}
+	return &Error{
+		ErrorCode:  ErrUnknown,
+		HTTPStatus: http.StatusNotFound,
 	}
 }
 
@@ -160,14 +405,122 @@ func (as *AppService) GetUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	vars := mux.Vars(r)
-	userID := id.UserID(vars["userID"])
-	ok := as.QueryHandler.QueryUser(userID)
-	if ok {
-		WriteBlankOK(w)
-	} else {
+	writeQueryResult(w, as.handleUserQuery(r.Context(), id.UserID(vars["userID"])))
+}
+
+// handleUserQuery answers a user ID query from the homeserver.
+// It returns the error that should be sent to the homeserver, or nil if the user exists.
+func (as *AppService) handleUserQuery(ctx context.Context, userID id.UserID) *Error {
+	if handler, ok := as.QueryHandler.(UserQueryHandler); ok {
+		ok, err := runWithTimeout(ctx, func(ctx context.Context) (bool, error) {
+			return as.provisionUser(ctx, handler, userID)
+		})
+		if err != nil {
+			as.Log.Warnfln("Failed to provision user %s: %v", userID, err)
+		}
+		return queryResultError(ok, err)
+	}
+	if as.QueryHandler.QueryUser(userID) {
+		return nil
+	}
+	return &Error{
+		ErrorCode:  ErrUnknown,
+		HTTPStatus: http.StatusNotFound,
+	}
+}
+
+// GetThirdPartyProtocol handles a /thirdparty/protocol GET call from the homeserver.
+func (as *AppService) GetThirdPartyProtocol(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	protocol := as.ThirdPartyHandler.GetProtocol(vars["protocol"])
+	if protocol == nil {
 		Error{
-			ErrorCode:  ErrUnknown,
+			ErrorCode:  ErrNotFound,
 			HTTPStatus: http.StatusNotFound,
+			Message:    "Unknown protocol.",
 		}.Write(w)
+		return
 	}
+	RespondJSON(w, http.StatusOK, protocol)
+}
+
+// GetThirdPartyLocation handles a /thirdparty/location/{protocol} GET call from the homeserver.
+func (as *AppService) GetThirdPartyLocation(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+
+	locations := as.ThirdPartyHandler.QueryLocation(parseThirdPartyQuery(r))
+	if len(locations) == 0 {
+		writeThirdPartyNotFound(w)
+		return
+	}
+	RespondJSON(w, http.StatusOK, locations)
+}
+
+// GetThirdPartyUser handles a /thirdparty/user/{protocol} GET call from the homeserver.
+func (as *AppService) GetThirdPartyUser(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+
+	users := as.ThirdPartyHandler.QueryUser(parseThirdPartyQuery(r))
+	if len(users) == 0 {
+		writeThirdPartyNotFound(w)
+		return
+	}
+	RespondJSON(w, http.StatusOK, users)
+}
+
+// GetThirdPartyLocationByAlias handles a /thirdparty/location GET call from the homeserver.
+func (as *AppService) GetThirdPartyLocationByAlias(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+
+	locations := as.ThirdPartyHandler.ReverseQueryLocation(id.RoomAlias(r.URL.Query().Get("alias")))
+	if len(locations) == 0 {
+		writeThirdPartyNotFound(w)
+		return
+	}
+	RespondJSON(w, http.StatusOK, locations)
+}
+
+// GetThirdPartyUserByID handles a /thirdparty/user GET call from the homeserver.
+func (as *AppService) GetThirdPartyUserByID(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+
+	users := as.ThirdPartyHandler.ReverseQueryUser(id.UserID(r.URL.Query().Get("userid")))
+	if len(users) == 0 {
+		writeThirdPartyNotFound(w)
+		return
+	}
+	RespondJSON(w, http.StatusOK, users)
+}
+
+func parseThirdPartyQuery(r *http.Request) ThirdPartyQuery {
+	query := ThirdPartyQuery{
+		Protocol: mux.Vars(r)["protocol"],
+		Fields:   make(map[string]string),
+	}
+	for key, values := range r.URL.Query() {
+		if key != "access_token" && len(values) > 0 {
+			query.Fields[key] = values[0]
+		}
+	}
+	return query
+}
+
+func writeThirdPartyNotFound(w http.ResponseWriter) {
+	Error{
+		ErrorCode:  ErrNotFound,
+		HTTPStatus: http.StatusNotFound,
+		Message:    "No results found.",
+	}.Write(w)
 }
@@ -7,6 +7,8 @@
 package appservice
 
 import (
+	"context"
+	"net/http"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -277,3 +279,151 @@ func (intent *IntentAPI) EnsureInvited(roomID id.RoomID, userID id.UserID) error
 	}
 	return nil
 }
+
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (ct *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return ct.next.RoundTrip(req.WithContext(ct.ctx))
+}
+
+// clientWithContext returns a copy of the given client whose HTTP requests are bound to the given context.
+func clientWithContext(client *mautrix.Client, ctx context.Context) *mautrix.Client {
+	if client == nil {
+		return nil
+	}
+	httpClient := *client.Client
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	httpClient.Transport = &contextTransport{ctx: ctx, next: next}
+	return &mautrix.Client{
+		HomeserverURL:    client.HomeserverURL,
+		Prefix:           client.Prefix,
+		UserID:           client.UserID,
+		DeviceID:         client.DeviceID,
+		AccessToken:      client.AccessToken,
+		UserAgent:        client.UserAgent,
+		Client:           &httpClient,
+		Logger:           client.Logger,
+		SyncPresence:     client.SyncPresence,
+		AppServiceUserID: client.AppServiceUserID,
+	}
+}
+
+// WithContext returns a copy of the intent whose requests to the homeserver are bound to the given context,
+// i.e. they're cancelled when the context is cancelled or its deadline passes.
+func (intent *IntentAPI) WithContext(ctx context.Context) *IntentAPI {
+	return &IntentAPI{
+		Client:    clientWithContext(intent.Client, ctx),
+		bot:       clientWithContext(intent.bot, ctx),
+		as:        intent.as,
+		Localpart: intent.Localpart,
+		UserID:    intent.UserID,
+
+		IsCustomPuppet: intent.IsCustomPuppet,
+	}
+}
+
+func (intent *IntentAPI) RegisterContext(ctx context.Context) error {
+	return intent.WithContext(ctx).Register()
+}
+
+func (intent *IntentAPI) EnsureRegisteredContext(ctx context.Context) error {
+	return intent.WithContext(ctx).EnsureRegistered()
+}
+
+func (intent *IntentAPI) EnsureJoinedContext(ctx context.Context, roomID id.RoomID) error {
+	return intent.WithContext(ctx).EnsureJoined(roomID)
+}
+
+func (intent *IntentAPI) SendMessageEventContext(ctx context.Context, roomID id.RoomID, eventType event.Type, contentJSON interface{}) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SendMessageEvent(roomID, eventType, contentJSON)
+}
+
+func (intent *IntentAPI) SendMassagedMessageEventContext(ctx context.Context, roomID id.RoomID, eventType event.Type, contentJSON interface{}, ts int64) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SendMassagedMessageEvent(roomID, eventType, contentJSON, ts)
+}
+
+func (intent *IntentAPI) SendStateEventContext(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SendStateEvent(roomID, eventType, stateKey, contentJSON)
+}
+
+func (intent *IntentAPI) SendMassagedStateEventContext(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}, ts int64) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SendMassagedStateEvent(roomID, eventType, stateKey, contentJSON, ts)
+}
+
+func (intent *IntentAPI) StateEventContext(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) error {
+	return intent.WithContext(ctx).StateEvent(roomID, eventType, stateKey, outContent)
+}
+
+func (intent *IntentAPI) MemberContext(ctx context.Context, roomID id.RoomID, userID id.UserID) *event.MemberEventContent {
+	return intent.WithContext(ctx).Member(roomID, userID)
+}
+
+func (intent *IntentAPI) PowerLevelsContext(ctx context.Context, roomID id.RoomID) (*event.PowerLevelsEventContent, error) {
+	return intent.WithContext(ctx).PowerLevels(roomID)
+}
+
+func (intent *IntentAPI) SetPowerLevelsContext(ctx context.Context, roomID id.RoomID, levels *event.PowerLevelsEventContent) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SetPowerLevels(roomID, levels)
+}
+
+func (intent *IntentAPI) SetPowerLevelContext(ctx context.Context, roomID id.RoomID, userID id.UserID, level int) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SetPowerLevel(roomID, userID, level)
+}
+
+func (intent *IntentAPI) UserTypingContext(ctx context.Context, roomID id.RoomID, typing bool, timeout int64) (*mautrix.RespTyping, error) {
+	return intent.WithContext(ctx).UserTyping(roomID, typing, timeout)
+}
+
+func (intent *IntentAPI) SendTextContext(ctx context.Context, roomID id.RoomID, text string) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SendText(roomID, text)
+}
+
+func (intent *IntentAPI) SendImageContext(ctx context.Context, roomID id.RoomID, body string, url id.ContentURI) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SendImage(roomID, body, url)
+}
+
+func (intent *IntentAPI) SendVideoContext(ctx context.Context, roomID id.RoomID, body string, url id.ContentURI) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SendVideo(roomID, body, url)
+}
+
+func (intent *IntentAPI) SendNoticeContext(ctx context.Context, roomID id.RoomID, text string) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SendNotice(roomID, text)
+}
+
+func (intent *IntentAPI) RedactEventContext(ctx context.Context, roomID id.RoomID, eventID id.EventID, req ...mautrix.ReqRedact) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).RedactEvent(roomID, eventID, req...)
+}
+
+func (intent *IntentAPI) SetRoomNameContext(ctx context.Context, roomID id.RoomID, roomName string) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SetRoomName(roomID, roomName)
+}
+
+func (intent *IntentAPI) SetRoomAvatarContext(ctx context.Context, roomID id.RoomID, avatarURL id.ContentURI) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SetRoomAvatar(roomID, avatarURL)
+}
+
+func (intent *IntentAPI) SetRoomTopicContext(ctx context.Context, roomID id.RoomID, topic string) (*mautrix.RespSendEvent, error) {
+	return intent.WithContext(ctx).SetRoomTopic(roomID, topic)
+}
+
+func (intent *IntentAPI) SetDisplayNameContext(ctx context.Context, displayName string) error {
+	return intent.WithContext(ctx).SetDisplayName(displayName)
+}
+
+func (intent *IntentAPI) SetAvatarURLContext(ctx context.Context, avatarURL id.ContentURI) error {
+	return intent.WithContext(ctx).SetAvatarURL(avatarURL)
+}
+
+func (intent *IntentAPI) WhoamiContext(ctx context.Context) (*mautrix.RespWhoami, error) {
+	return intent.WithContext(ctx).Whoami()
+}
+
+func (intent *IntentAPI) EnsureInvitedContext(ctx context.Context, roomID id.RoomID, userID id.UserID) error {
+	return intent.WithContext(ctx).EnsureInvited(roomID, userID)
+}
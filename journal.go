@@ -0,0 +1,333 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// TransactionJournal stores received transactions until all their events have been dispatched,
+// so that events aren't lost if the process dies before handling them.
+type TransactionJournal interface {
+	// Write saves the events of a transaction. It's called before the transaction is acknowledged.
+	// It must return ErrTransactionPending if the transaction was written before and isn't done yet.
+	Write(txnID string, events []*event.Event) error
+	// Discard removes a transaction that was written, but not acknowledged.
+	Discard(txnID string) error
+	// MarkDone marks an event as dispatched. Transactions are removed once all their events are done.
+	MarkDone(evt *event.Event) error
+	// Abandon stops tracking an event that won't be dispatched, but leaves it in the journal,
+	// so that it's returned by Unfinished after a restart.
+	Abandon(evt *event.Event)
+	// Unfinished returns the events that were written, but never marked as done.
+	// Transactions that are already being tracked are skipped, so calling it again doesn't return the same events.
+	Unfinished() ([]*event.Event, error)
+}
+
+// ErrTransactionPending is returned by TransactionJournal.Write if the events of a previous delivery of the same
+// transaction haven't all been handled yet.
+var ErrTransactionPending = errors.New("transaction is already being handled")
+
+type journalRef struct {
+	txnID string
+	index int
+}
+
+type journalEntry struct {
+	Class event.TypeClass `json:"class"`
+	Event *event.Event    `json:"event"`
+}
+
+// FileTransactionJournal is a TransactionJournal that stores each transaction as a JSON file in a directory.
+type FileTransactionJournal struct {
+	Path string
+
+	pending   map[*event.Event]journalRef
+	remaining map[string]int
+	lock      sync.Mutex
+}
+
+// NewFileTransactionJournal creates a FileTransactionJournal and makes sure the given directory exists.
+func NewFileTransactionJournal(path string) (*FileTransactionJournal, error) {
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTransactionJournal{
+		Path:      path,
+		pending:   make(map[*event.Event]journalRef),
+		remaining: make(map[string]int),
+	}, nil
+}
+
+func (journal *FileTransactionJournal) filePath(txnID, ext string) string {
+	return filepath.Join(journal.Path, base64.RawURLEncoding.EncodeToString([]byte(txnID))+ext)
+}
+
+func (journal *FileTransactionJournal) Write(txnID string, events []*event.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	entries := make([]journalEntry, len(events))
+	for i, evt := range events {
+		entries[i] = journalEntry{Class: evt.Type.Class, Event: evt}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	// Reserve the transaction ID first, so that a retry of a transaction that is still being handled
+	// can't overwrite the file or the remaining count of the first delivery.
+	journal.lock.Lock()
+	if _, ok := journal.remaining[txnID]; ok {
+		journal.lock.Unlock()
+		return ErrTransactionPending
+	}
+	journal.remaining[txnID] = len(events)
+	journal.lock.Unlock()
+
+	path := journal.filePath(txnID, ".json")
+	err = ioutil.WriteFile(path+".tmp", data, 0600)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	if err != nil {
+		delete(journal.remaining, txnID)
+		return err
+	}
+	for i, evt := range events {
+		journal.pending[evt] = journalRef{txnID, i}
+	}
+	return nil
+}
+
+func (journal *FileTransactionJournal) Discard(txnID string) error {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	for evt, ref := range journal.pending {
+		if ref.txnID == txnID {
+			delete(journal.pending, evt)
+		}
+	}
+	delete(journal.remaining, txnID)
+	return journal.remove(txnID)
+}
+
+func (journal *FileTransactionJournal) remove(txnID string) error {
+	err := os.Remove(journal.filePath(txnID, ".done"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(journal.filePath(txnID, ".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (journal *FileTransactionJournal) MarkDone(evt *event.Event) error {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	ref, ok := journal.pending[evt]
+	if !ok {
+		return nil
+	}
+	delete(journal.pending, evt)
+	journal.remaining[ref.txnID]--
+	if journal.remaining[ref.txnID] <= 0 {
+		delete(journal.remaining, ref.txnID)
+		return journal.remove(ref.txnID)
+	}
+	file, err := os.OpenFile(journal.filePath(ref.txnID, ".done"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strconv.Itoa(ref.index) + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (journal *FileTransactionJournal) Abandon(evt *event.Event) {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	ref, ok := journal.pending[evt]
+	if !ok {
+		return
+	}
+	delete(journal.pending, evt)
+	journal.remaining[ref.txnID]--
+	if journal.remaining[ref.txnID] <= 0 {
+		// The files are kept, as the abandoned events aren't done.
+		delete(journal.remaining, ref.txnID)
+	}
+}
+
+func (journal *FileTransactionJournal) readDone(txnID string) (map[int]bool, error) {
+	done := make(map[int]bool)
+	file, err := os.Open(journal.filePath(txnID, ".done"))
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		index, err := strconv.Atoi(scanner.Text())
+		if err == nil {
+			done[index] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+func (journal *FileTransactionJournal) Unfinished() ([]*event.Event, error) {
+	files, err := ioutil.ReadDir(journal.Path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	var events []*event.Event
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		rawTxnID, err := base64.RawURLEncoding.DecodeString(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		txnID := string(rawTxnID)
+		if _, ok := journal.remaining[txnID]; ok {
+			// Already replayed or currently being handled.
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(journal.Path, name))
+		if err != nil {
+			return nil, err
+		}
+		var entries []journalEntry
+		err = json.Unmarshal(data, &entries)
+		if err != nil {
+			return nil, err
+		}
+		done, err := journal.readDone(txnID)
+		if err != nil {
+			return nil, err
+		}
+		for i, entry := range entries {
+			if done[i] || entry.Event == nil {
+				continue
+			}
+			entry.Event.Type.Class = entry.Class
+			journal.pending[entry.Event] = journalRef{txnID, i}
+			journal.remaining[txnID]++
+			events = append(events, entry.Event)
+		}
+		if journal.remaining[txnID] == 0 {
+			_ = journal.remove(txnID)
+		}
+	}
+	return events, nil
+}
+
+// ReplayJournal pushes the events that were left unfinished in the journal into the event channels.
+// New transactions are held back until all the unfinished events have been queued.
+func (as *AppService) ReplayJournal() error {
+	if as.Journal == nil {
+		return nil
+	}
+	as.queueLock.Lock()
+	defer as.queueLock.Unlock()
+	return as.replayJournal()
+}
+
+// startJournalReplay takes the queue lock before returning and replays the journal in the background,
+// so that transactions received after this call are queued after the replayed events.
+func (as *AppService) startJournalReplay() {
+	if as.Journal == nil {
+		return
+	}
+	as.queueLock.Lock()
+	go func() {
+		defer as.queueLock.Unlock()
+		err := as.replayJournal()
+		if err != nil {
+			as.Log.Errorln("Failed to replay transaction journal:", err)
+		}
+	}()
+}
+
+// replayJournal queues the unfinished events of the journal. The caller must hold the queue lock.
+func (as *AppService) replayJournal() error {
+	events, err := as.Journal.Unfinished()
+	if err != nil {
+		return err
+	}
+	if len(events) > 0 {
+		as.Log.Infofln("Replaying %d unfinished events from the transaction journal", len(events))
+	}
+	for _, evt := range events {
+		as.parseContent(evt)
+		if evt.Type.IsToDevice() {
+			as.ToDeviceEvents <- evt
+		} else {
+			as.UpdateState(evt)
+			as.Events <- evt
+		}
+	}
+	return nil
+}
+
+func (as *AppService) markEventDone(evt *event.Event) {
+	if as.eventHolds.deferDone(evt) {
+		return
+	}
+	if as.Journal != nil {
+		err := as.Journal.MarkDone(evt)
+		if err != nil {
+			as.Log.Warnfln("Failed to mark event %s as done in the transaction journal: %v", evt.ID, err)
+		}
+	}
+	as.transactionEventDone(evt)
+	as.forgetEventContexts([]*event.Event{evt})
+	as.forgetToDeviceTargets([]*event.Event{evt})
+}
+
+// markEventDropped finishes an event whose handlers weren't called. The event is left pending in the journal,
+// so that it's replayed on the next start, and it's reported to the end hooks in Transaction.Failed.
+func (as *AppService) markEventDropped(evt *event.Event) {
+	if as.Journal != nil {
+		as.Journal.Abandon(evt)
+	}
+	as.transactionEventFailed(evt)
+	as.forgetEventContexts([]*event.Event{evt})
+	as.forgetToDeviceTargets([]*event.Event{evt})
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// DefaultLatencyBuckets are the histogram buckets (in seconds) used for handler and request latencies.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (hist *histogram) observe(bounds []float64, value float64) {
+	if hist.buckets == nil {
+		hist.buckets = make([]uint64, len(bounds))
+	}
+	for i, bound := range bounds {
+		if value <= bound {
+			hist.buckets[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+type requestKey struct {
+	method   string
+	endpoint string
+	status   string
+}
+
+// Metrics collects statistics about the appservice and exposes them in the Prometheus text format.
+//
+// All methods are safe to call on a nil *Metrics, which makes metrics collection optional.
+type Metrics struct {
+	buckets    []float64
+	eventTypes map[string]struct{}
+
+	transactions   uint64
+	events         map[string]uint64
+	parseFailures  map[string]uint64
+	handlerLatency map[string]*histogram
+	handlerPanics  map[string]uint64
+	requests       map[requestKey]*histogram
+	lock           sync.Mutex
+}
+
+// NewMetrics creates a new Metrics instance with the default latency buckets.
+func NewMetrics() *Metrics {
+	return NewMetricsWithBuckets(DefaultLatencyBuckets)
+}
+
+// NewMetricsWithBuckets creates a new Metrics instance with the given latency bucket bounds in seconds.
+// The bounds are copied, so changing the slice afterwards has no effect.
+func NewMetricsWithBuckets(buckets []float64) *Metrics {
+	bounds := make([]float64, len(buckets))
+	copy(bounds, buckets)
+	sort.Float64s(bounds)
+	eventTypes := make(map[string]struct{}, len(event.TypeMap))
+	for evtType := range event.TypeMap {
+		eventTypes[evtType.Type] = struct{}{}
+	}
+	return &Metrics{
+		buckets:        bounds,
+		eventTypes:     eventTypes,
+		events:         make(map[string]uint64),
+		parseFailures:  make(map[string]uint64),
+		handlerLatency: make(map[string]*histogram),
+		handlerPanics:  make(map[string]uint64),
+		requests:       make(map[requestKey]*histogram),
+	}
+}
+
+// otherEventType is the label used for event types that aren't known, so that remote users can't create
+// an unlimited number of metrics by sending events with random types.
+const otherEventType = "other"
+
+// AddEventTypes makes the given event types have their own label in the event metrics. Event types that are known
+// to mautrix and types that have handlers in a running EventProcessor are added automatically.
+func (metrics *Metrics) AddEventTypes(evtTypes ...event.Type) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	for _, evtType := range evtTypes {
+		metrics.eventTypes[evtType.Type] = struct{}{}
+	}
+}
+
+// eventTypeLabel returns the label for the given event type. The caller must hold the lock.
+func (metrics *Metrics) eventTypeLabel(evtType string) string {
+	if _, ok := metrics.eventTypes[evtType]; ok {
+		return evtType
+	}
+	return otherEventType
+}
+
+// TrackTransaction counts a transaction received from the homeserver.
+func (metrics *Metrics) TrackTransaction() {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	metrics.transactions++
+	metrics.lock.Unlock()
+}
+
+// TrackEvent counts an event of the given type received from the homeserver.
+func (metrics *Metrics) TrackEvent(evtType string) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	metrics.events[metrics.eventTypeLabel(evtType)]++
+	metrics.lock.Unlock()
+}
+
+// TrackParseFailure counts an event whose content couldn't be parsed.
+func (metrics *Metrics) TrackParseFailure(evtType string) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	metrics.parseFailures[metrics.eventTypeLabel(evtType)]++
+	metrics.lock.Unlock()
+}
+
+// TrackHandler records how long an event handler took and whether it panicked.
+func (metrics *Metrics) TrackHandler(evtType string, duration time.Duration, panicked bool) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	evtType = metrics.eventTypeLabel(evtType)
+	hist, ok := metrics.handlerLatency[evtType]
+	if !ok {
+		hist = &histogram{}
+		metrics.handlerLatency[evtType] = hist
+	}
+	hist.observe(metrics.buckets, duration.Seconds())
+	if panicked {
+		metrics.handlerPanics[evtType]++
+	}
+}
+
+// TrackRequest records an outgoing request to the homeserver.
+func (metrics *Metrics) TrackRequest(method, endpoint string, status int, duration time.Duration) {
+	if metrics == nil {
+		return
+	}
+	key := requestKey{method: method, endpoint: endpoint, status: "error"}
+	if status > 0 {
+		key.status = strconv.Itoa(status)
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	hist, ok := metrics.requests[key]
+	if !ok {
+		hist = &histogram{}
+		metrics.requests[key] = hist
+	}
+	hist.observe(metrics.buckets, duration.Seconds())
+}
+
+type metricsTransport struct {
+	metrics *Metrics
+	next    http.RoundTripper
+}
+
+func (mt *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := mt.next.RoundTrip(req)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	mt.metrics.TrackRequest(req.Method, normalizeEndpoint(req.URL), status, time.Since(start))
+	return resp, err
+}
+
+// WrapClient returns a HTTP client that records the requests made through it.
+// If metrics is nil, the client is returned as-is.
+func (metrics *Metrics) WrapClient(client *http.Client) *http.Client {
+	if metrics == nil {
+		return client
+	}
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	wrapped := *client
+	wrapped.Transport = &metricsTransport{metrics: metrics, next: next}
+	return &wrapped
+}
+
+// endpointParams maps path segments to the names of the variable segments that follow them.
+var endpointParams = map[string][]string{
+	"send":         {"{eventType}", "{txnID}"},
+	"state":        {"{eventType}", "{stateKey}"},
+	"sendToDevice": {"{eventType}", "{txnID}"},
+	"redact":       {"{eventID}", "{txnID}"},
+	"account_data": {"{type}"},
+	"download":     {"{serverName}", "{mediaID}"},
+	"thumbnail":    {"{serverName}", "{mediaID}"},
+	"appservice":   {"{appserviceID}"},
+}
+
+// normalizeEndpoint replaces the variable parts of a Matrix API path with placeholders,
+// so that requests to the same endpoint are counted together.
+func normalizeEndpoint(reqURL *url.URL) string {
+	parts := strings.Split(strings.TrimPrefix(reqURL.EscapedPath(), "/"), "/")
+	var params []string
+	for i, part := range parts {
+		if len(params) > 0 {
+			parts[i] = params[0]
+			params = params[1:]
+			continue
+		}
+		unescaped, err := url.PathUnescape(part)
+		if err == nil && len(unescaped) > 0 && strings.ContainsAny(unescaped[:1], "!@#$+") {
+			parts[i] = "{id}"
+		} else {
+			params = endpointParams[part]
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func writeCounter(w io.Writer, name, help, label string, values map[string]uint64) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, key, values[key])
+	}
+}
+
+func writeHistogram(w io.Writer, name, labels string, bounds []float64, hist *histogram) {
+	for i, bound := range bounds {
+		_, _ = fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), hist.buckets[i])
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, hist.count)
+	labels = strings.TrimSuffix(labels, ",")
+	if len(labels) > 0 {
+		labels = "{" + labels + "}"
+	}
+	_, _ = fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", name, labels, strconv.FormatFloat(hist.sum, 'g', -1, 64), name, labels, hist.count)
+}
+
+// Export writes all the collected metrics in the Prometheus text format.
+func (metrics *Metrics) Export(w io.Writer) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+
+	_, _ = fmt.Fprintf(w, "# HELP appservice_transactions_total Number of transactions received from the homeserver.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE appservice_transactions_total counter\nappservice_transactions_total %d\n", metrics.transactions)
+	writeCounter(w, "appservice_events_total", "Number of events received from the homeserver.", "type", metrics.events)
+	writeCounter(w, "appservice_event_parse_failures_total", "Number of events whose content failed to parse.", "type", metrics.parseFailures)
+	writeCounter(w, "appservice_handler_panics_total", "Number of panics in event handlers.", "type", metrics.handlerPanics)
+
+	_, _ = fmt.Fprintf(w, "# HELP appservice_handler_duration_seconds Time taken by event handlers.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE appservice_handler_duration_seconds histogram\n")
+	handlerTypes := make([]string, 0, len(metrics.handlerLatency))
+	for evtType := range metrics.handlerLatency {
+		handlerTypes = append(handlerTypes, evtType)
+	}
+	sort.Strings(handlerTypes)
+	for _, evtType := range handlerTypes {
+		writeHistogram(w, "appservice_handler_duration_seconds", fmt.Sprintf("type=%q,", evtType), metrics.buckets, metrics.handlerLatency[evtType])
+	}
+
+	_, _ = fmt.Fprintf(w, "# HELP appservice_request_duration_seconds Time taken by requests to the homeserver.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE appservice_request_duration_seconds histogram\n")
+	requestKeys := make([]requestKey, 0, len(metrics.requests))
+	for key := range metrics.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.endpoint != b.endpoint {
+			return a.endpoint < b.endpoint
+		} else if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, key := range requestKeys {
+		labels := fmt.Sprintf("method=%q,endpoint=%q,status=%q,", key.method, key.endpoint, key.status)
+		writeHistogram(w, "appservice_request_duration_seconds", labels, metrics.buckets, metrics.requests[key])
+	}
+}
+
+// GetMetrics handles a /metrics GET call. The request must have the metrics token.
+func (as *AppService) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+	if len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(as.MetricsToken)) != 1 {
+		Error{
+			ErrorCode:  ErrForbidden,
+			HTTPStatus: http.StatusForbidden,
+			Message:    "Bad token supplied.",
+		}.Write(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	stats := as.QueueStats()
+	_, _ = fmt.Fprintf(w, "# HELP appservice_event_queue_depth Number of events waiting in the event channels.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE appservice_event_queue_depth gauge\n")
+	_, _ = fmt.Fprintf(w, "appservice_event_queue_depth{queue=\"events\"} %d\n", stats.EventQueueDepth)
+	_, _ = fmt.Fprintf(w, "appservice_event_queue_depth{queue=\"to_device\"} %d\n", stats.ToDeviceQueueDepth)
+	_, _ = fmt.Fprintf(w, "# HELP appservice_refused_transactions_total Number of transactions refused because the event queue was full.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE appservice_refused_transactions_total counter\nappservice_refused_transactions_total %d\n", stats.RefusedTransactions)
+	as.Metrics.Export(w)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// Middleware wraps every handler call of an EventProcessor, e.g. to add logging or to skip some events.
+// A middleware can stop an event from reaching the handler by not calling next.
+type Middleware func(next EventHandler) EventHandler
+
+// Use adds middlewares to the chain that wraps every handler call. The first middleware added is the outermost,
+// i.e. it's called first and returns last. Middlewares should be added before the processor is started.
+func (ep *EventProcessor) Use(middlewares ...Middleware) {
+	ep.middlewares = append(ep.middlewares, middlewares...)
+}
+
+func (ep *EventProcessor) wrap(handler EventHandler) EventHandler {
+	for i := len(ep.middlewares) - 1; i >= 0; i-- {
+		handler = ep.middlewares[i](handler)
+	}
+	return handler
+}
+
+// RecoverMiddleware recovers and logs panics in the handler.
+//
+// Panics are always recovered outside the whole chain, so this is only needed to let the middlewares
+// before it finish normally when the handler panics. Panics recovered by it aren't counted as handler
+// failures in Metrics.
+func RecoverMiddleware(logger log.Logger) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, evt *event.Event) {
+			defer func() {
+				if err := recover(); err != nil {
+					logPanic(logger, err, evt)
+				}
+			}()
+			next(ctx, evt)
+		}
+	}
+}
+
+// LoggingMiddleware logs the ID, type, room and sender of every event passed to a handler at the debug level.
+func LoggingMiddleware(logger log.Logger) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, evt *event.Event) {
+			logger.Debugfln("Handling event id=%s type=%s class=%s room_id=%s sender=%s",
+				evt.ID, evt.Type.Type, evt.Type.Class.Name(), evt.RoomID, evt.Sender)
+			next(ctx, evt)
+		}
+	}
+}
+
+// TimingMiddleware measures how long the handler takes. Handler calls that take longer than the given
+// threshold are logged as warnings, others are logged at the debug level.
+// If the threshold is zero, slow handlers aren't warned about.
+func TimingMiddleware(logger log.Logger, slowThreshold time.Duration) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, evt *event.Event) {
+			start := time.Now()
+			defer func() {
+				duration := time.Since(start)
+				if slowThreshold > 0 && duration > slowThreshold {
+					logger.Warnfln("Handling %s (%s) in %s took %s", evt.ID, evt.Type.Type, evt.RoomID, duration)
+				} else {
+					logger.Debugfln("Handled %s (%s) in %s in %s", evt.ID, evt.Type.Type, evt.RoomID, duration)
+				}
+			}()
+			next(ctx, evt)
+		}
+	}
+}
+
+// FilterMiddleware only passes events for which the given function returns true to the handler.
+func FilterMiddleware(filter func(evt *event.Event) bool) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, evt *event.Event) {
+			if filter(evt) {
+				next(ctx, evt)
+			}
+		}
+	}
+}
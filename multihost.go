@@ -0,0 +1,217 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/maulogger/v2"
+)
+
+// MultiHost hosts several appservices on one HTTP listener.
+//
+// Requests are routed to an appservice by path prefix if the appservice was added with one, and otherwise by the
+// token in the request: the hs_token for homeserver calls, the admin token for the admin API, the metrics token
+// for /metrics and the shared secret for the provisioning API. Without a prefix, /_health and /_ready are
+// answered by the MultiHost itself for all the appservices. Each appservice keeps its own registration, intents,
+// stores and event channels, so they can be set up exactly like standalone appservices, except that Start and
+// Stop are called on the MultiHost.
+type MultiHost struct {
+	Host HostConfig
+	Log  maulogger.Logger
+
+	appservices []*AppService
+	prefixes    map[string]*AppService
+	// prefixOrder contains the keys of prefixes sorted by descending length, so that the longest prefix matches first.
+	prefixOrder []string
+	tokens      map[string]*AppService
+	started     bool
+	lock        sync.RWMutex
+	server      *http.Server
+}
+
+// MultiHostReadinessResponse is the response body of the /_ready endpoint of a MultiHost.
+type MultiHostReadinessResponse struct {
+	Ready       bool                          `json:"ready"`
+	AppServices map[string]*ReadinessResponse `json:"appservices"`
+}
+
+// NewMultiHost creates a MultiHost that listens according to the given host config.
+func NewMultiHost(host HostConfig, log maulogger.Logger) *MultiHost {
+	return &MultiHost{
+		Host:     host,
+		Log:      log,
+		prefixes: make(map[string]*AppService),
+		tokens:   make(map[string]*AppService),
+	}
+}
+
+// Add adds an initialized appservice to the host. If the prefix is not empty, requests under the prefix are routed
+// to the appservice with the prefix removed from the path. The appservice is always reachable by its tokens,
+// so they must not be shared with other hosted appservices.
+//
+// Appservices added after Start are started immediately.
+func (mh *MultiHost) Add(prefix string, as *AppService) error {
+	if as.Registration == nil {
+		return errors.New("appservice doesn't have a registration")
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	if len(prefix) > 0 && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+
+	tokens := as.routingTokens()
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	for _, token := range tokens {
+		if _, ok := mh.tokens[token]; ok {
+			return fmt.Errorf("a token of %s is already used by another hosted appservice", as.Registration.ID)
+		}
+	}
+	if _, ok := mh.prefixes[prefix]; ok && len(prefix) > 0 {
+		return fmt.Errorf("an appservice with the prefix %s is already hosted", prefix)
+	}
+	for _, token := range tokens {
+		mh.tokens[token] = as
+	}
+	if len(prefix) > 0 {
+		mh.prefixes[prefix] = as
+		mh.prefixOrder = append(mh.prefixOrder, prefix)
+		sort.SliceStable(mh.prefixOrder, func(i, j int) bool {
+			return len(mh.prefixOrder[i]) > len(mh.prefixOrder[j])
+		})
+	}
+	mh.appservices = append(mh.appservices, as)
+	if mh.started {
+		as.startHosted()
+	}
+	return nil
+}
+
+// Start starts all the hosted appservices and the HTTP server that listens for calls from the homeservers.
+func (mh *MultiHost) Start() {
+	mh.lock.Lock()
+	mh.server = &http.Server{
+		Addr:    mh.Host.Address(),
+		Handler: mh,
+	}
+	for _, as := range mh.appservices {
+		as.startHosted()
+	}
+	mh.started = true
+	mh.lock.Unlock()
+
+	mh.Log.Infoln("Listening on", mh.Host.Address())
+	listen(mh.server, &mh.Host, mh.Log)
+}
+
+// Stop stops all the hosted appservices and the HTTP server.
+func (mh *MultiHost) Stop() {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	for _, as := range mh.appservices {
+		as.Stop()
+	}
+	mh.started = false
+	if mh.server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = mh.server.Shutdown(ctx)
+	mh.server = nil
+}
+
+// routingTokens returns the tokens that requests to the appservice can be routed by.
+func (as *AppService) routingTokens() []string {
+	tokens := []string{as.Registration.ServerToken}
+	if len(as.AdminToken) > 0 {
+		tokens = append(tokens, as.AdminToken)
+	}
+	if len(as.MetricsToken) > 0 {
+		tokens = append(tokens, as.MetricsToken)
+	}
+	if len(as.Provisioning.SharedSecret) > 0 && as.Provisioning.SharedSecret != "disable" {
+		tokens = append(tokens, as.Provisioning.SharedSecret)
+	}
+	return tokens
+}
+
+// ServeHTTP routes a request to the right appservice.
+func (mh *MultiHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mh.lock.RLock()
+	for _, prefix := range mh.prefixOrder {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			as := mh.prefixes[prefix]
+			mh.lock.RUnlock()
+			http.StripPrefix(prefix, as.Router).ServeHTTP(w, r)
+			return
+		}
+	}
+	as, ok := mh.tokens[requestToken(r)]
+	mh.lock.RUnlock()
+	if r.Method == http.MethodGet && r.URL.Path == "/_health" {
+		WriteBlankOK(w)
+		return
+	} else if r.Method == http.MethodGet && r.URL.Path == "/_ready" {
+		mh.GetReady(w, r)
+		return
+	} else if !ok {
+		Error{
+			ErrorCode:  ErrForbidden,
+			HTTPStatus: http.StatusForbidden,
+			Message:    "Bad token supplied.",
+		}.Write(w)
+		return
+	}
+	as.Router.ServeHTTP(w, r)
+}
+
+// CheckReadiness runs the readiness checks of all the hosted appservices concurrently.
+func (mh *MultiHost) CheckReadiness() *MultiHostReadinessResponse {
+	mh.lock.RLock()
+	appservices := mh.appservices
+	mh.lock.RUnlock()
+
+	resp := &MultiHostReadinessResponse{
+		Ready:       true,
+		AppServices: make(map[string]*ReadinessResponse, len(appservices)),
+	}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	wg.Add(len(appservices))
+	for _, as := range appservices {
+		go func(as *AppService) {
+			defer wg.Done()
+			result := as.CheckReadiness()
+			lock.Lock()
+			resp.AppServices[as.Registration.ID] = result
+			resp.Ready = resp.Ready && result.Ready
+			lock.Unlock()
+		}(as)
+	}
+	wg.Wait()
+	return resp
+}
+
+// GetReady handles a /_ready GET call that wasn't routed to a single appservice.
+func (mh *MultiHost) GetReady(w http.ResponseWriter, _ *http.Request) {
+	resp := mh.CheckReadiness()
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	RespondJSON(w, status, resp)
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// PingStatus is the outcome of a homeserver -> appservice connectivity check.
+type PingStatus string
+
+const (
+	// PingOK means the homeserver successfully reached the appservice and the tokens match.
+	PingOK PingStatus = "ok"
+	// PingBadServerToken means the homeserver reached the appservice, but the appservice rejected its hs_token.
+	PingBadServerToken PingStatus = "bad_hs_token"
+	// PingBadAppToken means the homeserver rejected the as_token of the appservice.
+	PingBadAppToken PingStatus = "bad_as_token"
+	// PingURLNotSet means the registration on the homeserver doesn't have an URL.
+	PingURLNotSet PingStatus = "url_not_set"
+	// PingAppServiceUnreachable means the homeserver couldn't connect to the URL in the registration.
+	PingAppServiceUnreachable PingStatus = "appservice_unreachable"
+	// PingHomeserverUnreachable means the appservice couldn't connect to the homeserver URL in the config.
+	PingHomeserverUnreachable PingStatus = "homeserver_unreachable"
+	// PingTimeout means either the homeserver or the appservice didn't respond in time.
+	PingTimeout PingStatus = "timeout"
+	// PingUnsupported means the homeserver doesn't implement the ping endpoint.
+	PingUnsupported PingStatus = "unsupported"
+	// PingUnknownError means the ping failed for some other reason.
+	PingUnknownError PingStatus = "unknown_error"
+)
+
+// PingResult contains the result of AppService.Ping.
+type PingResult struct {
+	Status PingStatus
+	// Duration is the round trip time from the homeserver to the appservice as reported by the homeserver.
+	Duration time.Duration
+	// HTTPStatus is the status code the homeserver responded with.
+	HTTPStatus int
+	// AppServiceStatus is the status code the appservice gave to the homeserver, if the homeserver reported it.
+	AppServiceStatus int
+	ErrorCode        string
+	Message          string
+	Err              error
+}
+
+// OK returns true if the ping was successful.
+func (pr *PingResult) OK() bool {
+	return pr.Status == PingOK
+}
+
+func (pr *PingResult) String() string {
+	switch pr.Status {
+	case PingOK:
+		return fmt.Sprintf("homeserver reached the appservice in %s", pr.Duration)
+	case PingBadServerToken:
+		return "appservice rejected the hs_token sent by the homeserver"
+	case PingBadAppToken:
+		return "homeserver rejected the as_token of the appservice"
+	case PingURLNotSet:
+		return "appservice URL is not set in the registration on the homeserver"
+	case PingAppServiceUnreachable:
+		return fmt.Sprintf("homeserver can't reach the appservice: %s", pr.Message)
+	case PingHomeserverUnreachable:
+		return fmt.Sprintf("appservice can't reach the homeserver: %v", pr.Err)
+	case PingTimeout:
+		return "ping timed out"
+	case PingUnsupported:
+		return "homeserver doesn't support pinging appservices"
+	default:
+		if pr.Err != nil {
+			return fmt.Sprintf("unknown error: %v", pr.Err)
+		}
+		return fmt.Sprintf("unknown error: HTTP %d: %s: %s", pr.HTTPStatus, pr.ErrorCode, pr.Message)
+	}
+}
+
+type reqPing struct {
+	TxnID string `json:"transaction_id,omitempty"`
+}
+
+type respPing struct {
+	DurationMS int64 `json:"duration_ms"`
+}
+
+type respPingError struct {
+	ErrorCode string `json:"errcode"`
+	Message   string `json:"error"`
+	Status    int    `json:"status"`
+}
+
+var pingPaths = []string{
+	"/_matrix/client/v1/appservice/%s/ping",
+	"/_matrix/client/unstable/fi.mau.msc2659/appservice/%s/ping",
+}
+
+// Ping asks the homeserver to ping the appservice (MSC2659) using the as_token of the registration.
+//
+// The result tells whether the homeserver and appservice can reach each other and whether both tokens are correct.
+func (as *AppService) Ping(ctx context.Context) *PingResult {
+	var result *PingResult
+	for _, path := range pingPaths {
+		result = as.ping(ctx, as.HomeserverURL+fmt.Sprintf(path, url.PathEscape(as.Registration.ID)))
+		if result.Status != PingUnsupported {
+			break
+		}
+	}
+	return result
+}
+
+func (as *AppService) ping(ctx context.Context, pingURL string) *PingResult {
+	reqBody, _ := json.Marshal(&reqPing{TxnID: RandomString(32)})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pingURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return &PingResult{Status: PingUnknownError, Err: err}
+	}
+	req.Header.Set("Authorization", "Bearer "+as.Registration.AppToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &PingResult{Status: PingTimeout, Err: err}
+	} else if err != nil {
+		return &PingResult{Status: PingHomeserverUnreachable, Err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &PingResult{Status: PingUnknownError, HTTPStatus: resp.StatusCode, Err: err}
+	}
+
+	result := &PingResult{HTTPStatus: resp.StatusCode}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		var pingResp respPing
+		err = json.Unmarshal(body, &pingResp)
+		if err != nil {
+			result.Status = PingUnknownError
+			result.Err = err
+		} else {
+			result.Status = PingOK
+			result.Duration = time.Duration(pingResp.DurationMS) * time.Millisecond
+		}
+		return result
+	}
+
+	var errResp respPingError
+	_ = json.Unmarshal(body, &errResp)
+	result.ErrorCode = errResp.ErrorCode
+	result.Message = errResp.Message
+	result.AppServiceStatus = errResp.Status
+	switch {
+	case errResp.ErrorCode == "M_UNRECOGNIZED" || (len(errResp.ErrorCode) == 0 && resp.StatusCode == http.StatusNotFound):
+		result.Status = PingUnsupported
+	case errResp.ErrorCode == "M_UNKNOWN_TOKEN" || errResp.ErrorCode == "M_FORBIDDEN" || resp.StatusCode == http.StatusUnauthorized:
+		result.Status = PingBadAppToken
+	case errResp.ErrorCode == "M_URL_NOT_SET":
+		result.Status = PingURLNotSet
+	case errResp.ErrorCode == "M_BAD_STATUS" && (errResp.Status == http.StatusForbidden || errResp.Status == http.StatusUnauthorized):
+		result.Status = PingBadServerToken
+	case errResp.ErrorCode == "M_CONNECTION_FAILED":
+		result.Status = PingAppServiceUnreachable
+	case errResp.ErrorCode == "M_CONNECTION_TIMEOUT" || resp.StatusCode == http.StatusGatewayTimeout:
+		result.Status = PingTimeout
+	default:
+		result.Status = PingUnknownError
+	}
+	if len(result.Message) == 0 {
+		result.Message = strings.TrimSpace(string(body))
+	}
+	return result
+}
+
+// PostPing handles a /ping POST call from the homeserver.
+func (as *AppService) PostPing(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+
+	defer r.Body.Close()
+	body, _ := ioutil.ReadAll(r.Body)
+	var req reqPing
+	if len(body) > 0 && json.Unmarshal(body, &req) != nil {
+		Error{
+			ErrorCode:  ErrInvalidJSON,
+			HTTPStatus: http.StatusBadRequest,
+			Message:    "Failed to parse body JSON.",
+		}.Write(w)
+		return
+	}
+	as.Log.Debugfln("Received ping from homeserver (transaction ID: %s)", req.TxnID)
+	WriteBlankOK(w)
+}
@@ -9,18 +9,209 @@ package appservice
 import (
 	"encoding/json"
 	"net/http"
+	"sync"
+	"sync/atomic"
 
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 // EventList contains a list of events.
 type EventList struct {
-	Events []*event.Event `json:"events"`
+	Events        []*event.Event `json:"events"`
+	Ephemeral     []*event.Event `json:"ephemeral,omitempty"`
+	SoruEphemeral []*event.Event `json:"de.sorunome.msc2409.ephemeral,omitempty"`
+	ToDevice      []*event.Event `json:"to_device,omitempty"`
+	SoruToDevice  []*event.Event `json:"de.sorunome.msc2409.to_device,omitempty"`
+
+	DeviceLists        *DeviceLists `json:"device_lists,omitempty"`
+	MSC3202DeviceLists *DeviceLists `json:"org.matrix.msc3202.device_lists,omitempty"`
+
+	DeviceOTKCount        OTKCountMap `json:"device_one_time_keys_count,omitempty"`
+	MSC3202DeviceOTKCount OTKCountMap `json:"org.matrix.msc3202.device_one_time_keys_count,omitempty"`
+
+	toDeviceTargets map[*event.Event]toDeviceTarget
+}
+
+type toDeviceTarget struct {
+	UserID   id.UserID   `json:"to_user_id"`
+	DeviceID id.DeviceID `json:"to_device_id"`
+}
+
+type toDeviceTargets struct {
+	targets map[*event.Event]toDeviceTarget
+	lock    sync.Mutex
+}
+
+// UnmarshalJSON parses an event list and remembers the recipients of the to-device events in it.
+func (el *EventList) UnmarshalJSON(data []byte) error {
+	type eventListAlias EventList
+	err := json.Unmarshal(data, (*eventListAlias)(el))
+	if err != nil || (len(el.ToDevice) == 0 && len(el.SoruToDevice) == 0) {
+		return err
+	}
+	var targets struct {
+		ToDevice     []toDeviceTarget `json:"to_device"`
+		SoruToDevice []toDeviceTarget `json:"de.sorunome.msc2409.to_device"`
+	}
+	err = json.Unmarshal(data, &targets)
+	if err != nil {
+		return err
+	}
+	el.addToDeviceTargets(el.ToDevice, targets.ToDevice)
+	el.addToDeviceTargets(el.SoruToDevice, targets.SoruToDevice)
+	return nil
+}
+
+func (el *EventList) addToDeviceTargets(evts []*event.Event, targets []toDeviceTarget) {
+	for i, evt := range evts {
+		if evt == nil || i >= len(targets) || len(targets[i].UserID) == 0 {
+			continue
+		}
+		if el.toDeviceTargets == nil {
+			el.toDeviceTargets = make(map[*event.Event]toDeviceTarget)
+		}
+		el.toDeviceTargets[evt] = targets[i]
+	}
+}
+
+// trackToDeviceTargets remembers the recipients of the to-device events in the given list until the events are done.
+// Like contexts, they're only tracked while an EventProcessor is running, as nothing else would forget them.
+func (as *AppService) trackToDeviceTargets(eventList *EventList) {
+	if atomic.LoadInt32(&as.runningProcessors) == 0 || len(eventList.toDeviceTargets) == 0 {
+		return
+	}
+	as.deviceTargets.lock.Lock()
+	defer as.deviceTargets.lock.Unlock()
+	if as.deviceTargets.targets == nil {
+		as.deviceTargets.targets = make(map[*event.Event]toDeviceTarget)
+	}
+	for evt, target := range eventList.toDeviceTargets {
+		as.deviceTargets.targets[evt] = target
+	}
+}
+
+func (as *AppService) forgetToDeviceTargets(events []*event.Event) {
+	as.deviceTargets.lock.Lock()
+	defer as.deviceTargets.lock.Unlock()
+	for _, evt := range events {
+		delete(as.deviceTargets.targets, evt)
+	}
+}
+
+// ToDeviceTarget returns the user and device that a to-device event pushed by the homeserver was sent to.
+// The recipient is known until the handlers of the event have returned. It's empty for events replayed
+// from the transaction journal and for to-device events received through sync, which are always for the bot.
+func (as *AppService) ToDeviceTarget(evt *event.Event) (id.UserID, id.DeviceID) {
+	as.deviceTargets.lock.Lock()
+	target := as.deviceTargets.targets[evt]
+	as.deviceTargets.lock.Unlock()
+	return target.UserID, target.DeviceID
+}
+
+// EphemeralEvents returns the ephemeral events in the list, using the unstable MSC2409 field as a fallback.
+func (el *EventList) EphemeralEvents() []*event.Event {
+	if len(el.Ephemeral) == 0 {
+		return el.SoruEphemeral
+	}
+	return el.Ephemeral
 }
 
+func (el *EventList) allEvents() []*event.Event {
+	ephemeral := el.EphemeralEvents()
+	toDevice := el.ToDeviceEvents()
+	events := make([]*event.Event, 0, len(el.Events)+len(ephemeral)+len(toDevice))
+	events = append(events, el.Events...)
+	events = append(events, ephemeral...)
+	return append(events, toDevice...)
+}
+
+// ToDeviceEvents returns the to-device events in the list, using the unstable MSC2409 field as a fallback.
+func (el *EventList) ToDeviceEvents() []*event.Event {
+	if len(el.ToDevice) == 0 {
+		return el.SoruToDevice
+	}
+	return el.ToDevice
+}
+
+// DeviceListChanges returns the device list changes in the list, using the unstable MSC3202 field as a fallback.
+func (el *EventList) DeviceListChanges() *DeviceLists {
+	if el.DeviceLists == nil {
+		return el.MSC3202DeviceLists
+	}
+	return el.DeviceLists
+}
+
+// OTKCounts returns the one-time key counts in the list, using the unstable MSC3202 field as a fallback.
+func (el *EventList) OTKCounts() OTKCountMap {
+	if len(el.DeviceOTKCount) == 0 {
+		return el.MSC3202DeviceOTKCount
+	}
+	return el.DeviceOTKCount
+}
+
+// DeviceLists contains the users whose device lists have changed or who no longer share any encrypted rooms.
+type DeviceLists struct {
+	Changed []id.UserID `json:"changed,omitempty"`
+	Left    []id.UserID `json:"left,omitempty"`
+}
+
+// OTKCountMap contains the number of unclaimed one-time keys for each appservice-controlled device.
+type OTKCountMap map[id.UserID]map[id.DeviceID]mautrix.OneTimeKeysCount
+
+// DeviceListHandler is a function that receives device list changes.
+type DeviceListHandler func(lists *DeviceLists)
+
+// OTKCountHandler is a function that receives one-time key counts.
+type OTKCountHandler func(otkCounts OTKCountMap)
+
 // EventListener is a function that receives events.
 type EventListener func(evt *event.Event)
 
+// ThirdPartyQuery contains the protocol and fields of a third party user or location lookup.
+type ThirdPartyQuery struct {
+	Protocol string
+	Fields   map[string]string
+}
+
+// ThirdPartyProtocol contains the metadata of a third party protocol that the appservice bridges to.
+type ThirdPartyProtocol struct {
+	UserFields     []string                       `json:"user_fields"`
+	LocationFields []string                       `json:"location_fields"`
+	Icon           string                         `json:"icon"`
+	FieldTypes     map[string]ThirdPartyFieldType `json:"field_types"`
+	Instances      []ThirdPartyProtocolInstance   `json:"instances"`
+}
+
+// ThirdPartyFieldType describes how a user or location field of a third party protocol is formatted.
+type ThirdPartyFieldType struct {
+	Regexp      string `json:"regexp"`
+	Placeholder string `json:"placeholder"`
+}
+
+// ThirdPartyProtocolInstance is a single network of a third party protocol, e.g. a specific IRC server.
+type ThirdPartyProtocolInstance struct {
+	Description string            `json:"desc"`
+	Icon        string            `json:"icon,omitempty"`
+	Fields      map[string]string `json:"fields"`
+	NetworkID   string            `json:"network_id"`
+}
+
+// ThirdPartyLocation is a Matrix room alias that corresponds to a location in a third party network.
+type ThirdPartyLocation struct {
+	Alias    id.RoomAlias      `json:"alias"`
+	Protocol string            `json:"protocol"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// ThirdPartyUser is a Matrix user ID that corresponds to a user in a third party network.
+type ThirdPartyUser struct {
+	UserID   id.UserID         `json:"userid"`
+	Protocol string            `json:"protocol"`
+	Fields   map[string]string `json:"fields"`
+}
+
 // WriteBlankOK writes a blank OK message as a reply to a HTTP request.
 func WriteBlankOK(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusOK)
@@ -37,6 +228,13 @@ func Respond(w http.ResponseWriter, data interface{}) error {
 	return err
 }
 
+// RespondJSON responds to a HTTP request with the given status code and JSON object.
+func RespondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = Respond(w, data)
+}
+
 // Error represents a Matrix protocol error.
 type Error struct {
 	HTTPStatus int       `json:"-"`
@@ -54,8 +252,12 @@ type ErrorCode string
 
 // Native ErrorCodes
 const (
-	ErrForbidden ErrorCode = "M_FORBIDDEN"
-	ErrUnknown   ErrorCode = "M_UNKNOWN"
+	ErrForbidden    ErrorCode = "M_FORBIDDEN"
+	ErrUnknown      ErrorCode = "M_UNKNOWN"
+	ErrNotFound     ErrorCode = "M_NOT_FOUND"
+	ErrMissingParam ErrorCode = "M_MISSING_PARAM"
+	ErrInvalidParam ErrorCode = "M_INVALID_PARAM"
+	ErrUnknownToken ErrorCode = "M_UNKNOWN_TOKEN"
 )
 
 // Custom ErrorCodes
@@ -63,4 +265,7 @@ const (
 	ErrNoTransactionID ErrorCode = "NET.MAUNIUM.NO_TRANSACTION_ID"
 	ErrNoBody          ErrorCode = "NET.MAUNIUM.NO_REQUEST_BODY"
 	ErrInvalidJSON     ErrorCode = "NET.MAUNIUM.INVALID_JSON"
+	ErrQueueFull       ErrorCode = "NET.MAUNIUM.QUEUE_FULL"
+
+	ErrTransactionInProgress ErrorCode = "NET.MAUNIUM.TRANSACTION_IN_PROGRESS"
 )
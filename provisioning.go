@@ -0,0 +1,195 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultProvisioningPrefix is the path prefix of the provisioning API if one isn't configured.
+const DefaultProvisioningPrefix = "/_matrix/provision/v1"
+
+// ProvisioningLevel is the permission level of a user in the provisioning API.
+type ProvisioningLevel string
+
+// Provisioning permission levels, from lowest to highest.
+const (
+	ProvisioningLevelNone  ProvisioningLevel = ""
+	ProvisioningLevelUser  ProvisioningLevel = "user"
+	ProvisioningLevelAdmin ProvisioningLevel = "admin"
+)
+
+func (level ProvisioningLevel) rank() int {
+	switch level {
+	case ProvisioningLevelUser:
+		return 1
+	case ProvisioningLevelAdmin:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Allows checks if the level is at least the given required level.
+func (level ProvisioningLevel) Allows(required ProvisioningLevel) bool {
+	return level.rank() >= required.rank()
+}
+
+// ProvisioningConfig contains the settings of the provisioning API.
+type ProvisioningConfig struct {
+	Prefix       string `yaml:"prefix"`
+	SharedSecret string `yaml:"shared_secret"`
+	// Permissions maps user IDs, server names or * to permission levels.
+	// The most specific entry that matches a user is used.
+	Permissions map[string]ProvisioningLevel `yaml:"permissions"`
+}
+
+// GetLevel returns the permission level of the given user.
+func (pc *ProvisioningConfig) GetLevel(userID id.UserID) ProvisioningLevel {
+	if level, ok := pc.Permissions[string(userID)]; ok {
+		return level
+	}
+	_, homeserver, err := userID.Parse()
+	if err == nil {
+		if level, ok := pc.Permissions[homeserver]; ok {
+			return level
+		}
+	}
+	return pc.Permissions["*"]
+}
+
+type provisioningContextKey int
+
+const (
+	provisioningUserIDKey provisioningContextKey = iota
+	provisioningLevelKey
+)
+
+// ProvisioningUserID returns the user on whose behalf a provisioning API request was made.
+func ProvisioningUserID(r *http.Request) id.UserID {
+	userID, _ := r.Context().Value(provisioningUserIDKey).(id.UserID)
+	return userID
+}
+
+// ProvisioningUserLevel returns the permission level of the user who made a provisioning API request.
+func ProvisioningUserLevel(r *http.Request) ProvisioningLevel {
+	level, _ := r.Context().Value(provisioningLevelKey).(ProvisioningLevel)
+	return level
+}
+
+// ProvisioningAPI is an HTTP API for bridge management, e.g. logging in and linking portals.
+//
+// Requests must be authenticated with the shared secret and have a user_id query parameter
+// for the user on whose behalf the request is made. The user must have the permission level
+// that the endpoint was registered with.
+type ProvisioningAPI struct {
+	as     *AppService
+	log    log.Logger
+	router *mux.Router
+}
+
+// ProvisioningWhoamiResponse is the response body of the built-in whoami endpoint.
+type ProvisioningWhoamiResponse struct {
+	UserID id.UserID         `json:"user_id"`
+	Level  ProvisioningLevel `json:"permission_level"`
+}
+
+// NewProvisioningAPI mounts the provisioning API on the router of the given appservice.
+// It returns nil if no shared secret is configured, in which case the API is disabled.
+func NewProvisioningAPI(as *AppService) *ProvisioningAPI {
+	if len(as.Provisioning.SharedSecret) == 0 || as.Provisioning.SharedSecret == "disable" {
+		return nil
+	}
+	prefix := as.Provisioning.Prefix
+	if len(prefix) == 0 {
+		prefix = DefaultProvisioningPrefix
+	}
+	prov := &ProvisioningAPI{
+		as:     as,
+		log:    as.Log.Sub("Provisioning"),
+		router: as.Router.PathPrefix(prefix).Subrouter(),
+	}
+	prov.router.Use(prov.authMiddleware)
+	prov.Handle(http.MethodGet, "/whoami", ProvisioningLevelUser, prov.GetWhoami)
+	return prov
+}
+
+// Handle registers a handler for the given method and path under the provisioning prefix.
+// Only users with at least the given permission level can call it.
+func (prov *ProvisioningAPI) Handle(method, path string, level ProvisioningLevel, handler http.HandlerFunc) {
+	if prov == nil {
+		return
+	}
+	prov.router.Handle(path, prov.requireLevel(level, handler)).Methods(method)
+}
+
+func (prov *ProvisioningAPI) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(prov.as.Provisioning.SharedSecret)) != 1 {
+			Error{
+				ErrorCode:  ErrUnknownToken,
+				HTTPStatus: http.StatusForbidden,
+				Message:    "Invalid auth token.",
+			}.Write(w)
+			return
+		}
+		rawUserID := r.URL.Query().Get("user_id")
+		if len(rawUserID) == 0 {
+			Error{
+				ErrorCode:  ErrMissingParam,
+				HTTPStatus: http.StatusBadRequest,
+				Message:    "Missing user_id query parameter.",
+			}.Write(w)
+			return
+		}
+		userID := id.UserID(rawUserID)
+		if _, _, err := userID.Parse(); err != nil {
+			Error{
+				ErrorCode:  ErrInvalidParam,
+				HTTPStatus: http.StatusBadRequest,
+				Message:    "Invalid user ID.",
+			}.Write(w)
+			return
+		}
+		ctx := context.WithValue(r.Context(), provisioningUserIDKey, userID)
+		ctx = context.WithValue(ctx, provisioningLevelKey, prov.as.Provisioning.GetLevel(userID))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (prov *ProvisioningAPI) requireLevel(required ProvisioningLevel, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level := ProvisioningUserLevel(r)
+		if level == ProvisioningLevelNone || !level.Allows(required) {
+			prov.log.Debugfln("Rejecting %s %s from %s: permission level %q is too low", r.Method, r.URL.Path, ProvisioningUserID(r), level)
+			Error{
+				ErrorCode:  ErrForbidden,
+				HTTPStatus: http.StatusForbidden,
+				Message:    "You don't have permission to do that.",
+			}.Write(w)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// GetWhoami returns the user ID and permission level of the requester.
+func (prov *ProvisioningAPI) GetWhoami(w http.ResponseWriter, r *http.Request) {
+	RespondJSON(w, http.StatusOK, &ProvisioningWhoamiResponse{
+		UserID: ProvisioningUserID(r),
+		Level:  ProvisioningUserLevel(r),
+	})
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// QueryProvisionTimeout is how long the framework may spend creating rooms or users for a query from the homeserver.
+var QueryProvisionTimeout = 30 * time.Second
+
+var errQueryTimeout = errors.New("timed out")
+
+// RoomCreationSpec describes a room that should be created for a queried room alias.
+type RoomCreationSpec struct {
+	Name         string
+	Topic        string
+	Preset       string
+	Visibility   string
+	IsDirect     bool
+	InitialState []*event.Event
+	Invite       []id.UserID
+	PowerLevels  *event.PowerLevelsEventContent
+
+	CreationContent map[string]interface{}
+}
+
+// AliasQueryHandler is an optional interface that a QueryHandler can implement to have the framework create rooms
+// for queried aliases.
+//
+// If the handler returns a spec, the room is created by the appservice bot with the queried alias.
+// If it returns nil, the alias is reported as not found.
+type AliasQueryHandler interface {
+	QueryAliasRoom(alias id.RoomAlias) (*RoomCreationSpec, error)
+}
+
+type reqCreatePortal struct {
+	mautrix.ReqCreateRoom
+	PowerLevelOverride *event.PowerLevelsEventContent `json:"power_level_content_override,omitempty"`
+}
+
+// CreatePortal creates a room from the given spec using the bot intent, with the given alias localpart.
+func (as *AppService) CreatePortal(aliasLocalpart string, spec *RoomCreationSpec) (id.RoomID, error) {
+	return as.CreatePortalContext(as.Context(), aliasLocalpart, spec)
+}
+
+// CreatePortalContext creates a room like CreatePortal, cancelling the requests if the given context is cancelled.
+func (as *AppService) CreatePortalContext(ctx context.Context, aliasLocalpart string, spec *RoomCreationSpec) (id.RoomID, error) {
+	bot := as.BotIntent().WithContext(ctx)
+	err := bot.EnsureRegistered()
+	if err != nil {
+		return "", err
+	}
+	req := &reqCreatePortal{
+		ReqCreateRoom: mautrix.ReqCreateRoom{
+			Visibility:      spec.Visibility,
+			RoomAliasName:   aliasLocalpart,
+			Name:            spec.Name,
+			Topic:           spec.Topic,
+			Invite:          spec.Invite,
+			CreationContent: spec.CreationContent,
+			InitialState:    spec.InitialState,
+			Preset:          spec.Preset,
+			IsDirect:        spec.IsDirect,
+		},
+		PowerLevelOverride: spec.PowerLevels,
+	}
+	var resp mautrix.RespCreateRoom
+	_, err = bot.MakeRequest(http.MethodPost, bot.BuildURL("createRoom"), req, &resp)
+	if err != nil {
+		return "", err
+	}
+	as.StateStore.SetMembership(resp.RoomID, bot.UserID, event.MembershipJoin)
+	for _, userID := range spec.Invite {
+		as.StateStore.SetMembership(resp.RoomID, userID, event.MembershipInvite)
+	}
+	if spec.PowerLevels != nil {
+		as.StateStore.SetPowerLevels(resp.RoomID, spec.PowerLevels)
+	}
+	return resp.RoomID, nil
+}
+
+func (as *AppService) provisionAlias(ctx context.Context, handler AliasQueryHandler, alias id.RoomAlias) (bool, error) {
+	parts := strings.SplitN(strings.TrimPrefix(string(alias), "#"), ":", 2)
+	if len(parts) != 2 || parts[1] != as.HomeserverDomain {
+		return false, nil
+	}
+	localpart := parts[0]
+	spec, err := handler.QueryAliasRoom(alias)
+	if err != nil || spec == nil {
+		return false, err
+	}
+	roomID, err := as.CreatePortalContext(ctx, localpart, spec)
+	if err != nil {
+		var httpErr mautrix.HTTPError
+		if errors.As(err, &httpErr) && httpErr.RespError != nil && httpErr.RespError.ErrCode == "M_ROOM_IN_USE" {
+			// Someone else created the alias while we were working, so it exists now.
+			return true, nil
+		}
+		return false, err
+	}
+	as.Log.Debugfln("Created %s for alias query %s", roomID, alias)
+	return true, nil
+}
+
+// UserProfile is the profile that should be set for a queried user.
+type UserProfile struct {
+	DisplayName string
+	AvatarURL   id.ContentURI
+}
+
+// UserQueryHandler is an optional interface that a QueryHandler can implement to have the framework register
+// queried users.
+//
+// If the handler returns a profile, the user is registered and the profile is set before the query is answered.
+// If it returns nil, the user is reported as not found.
+type UserQueryHandler interface {
+	QueryUserProfile(userID id.UserID) (*UserProfile, error)
+}
+
+func (as *AppService) provisionUser(ctx context.Context, handler UserQueryHandler, userID id.UserID) (bool, error) {
+	if as.StateStore.IsRegistered(userID) {
+		return true, nil
+	}
+	intent := as.Intent(userID)
+	if intent == nil {
+		return false, nil
+	}
+	profile, err := handler.QueryUserProfile(userID)
+	if err != nil || profile == nil {
+		return false, err
+	}
+	intent = intent.WithContext(ctx)
+	err = intent.EnsureRegistered()
+	if err != nil {
+		return false, err
+	}
+	if len(profile.DisplayName) > 0 {
+		err = intent.SetDisplayName(profile.DisplayName)
+		if err != nil {
+			return false, err
+		}
+	}
+	if !profile.AvatarURL.IsEmpty() {
+		err = intent.SetAvatarURL(profile.AvatarURL)
+		if err != nil {
+			return false, err
+		}
+	}
+	as.Log.Debugfln("Registered %s for user query", userID)
+	return true, nil
+}
+
+// runWithTimeout runs the given provisioning function with a context that is cancelled
+// after QueryProvisionTimeout or when the homeserver stops waiting for the response.
+func runWithTimeout(parent context.Context, fn func(ctx context.Context) (bool, error)) (bool, error) {
+	ctx, cancel := context.WithTimeout(parent, QueryProvisionTimeout)
+	defer cancel()
+	ok, err := fn(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return false, errQueryTimeout
+	}
+	return ok, err
+}
+
+// queryResultError converts the result of provisioning a room or user into the error
+// that should be sent to the homeserver, or nil if the queried entity exists.
+//
+// Errors from the homeserver, like M_FORBIDDEN when creating a room, are answered with a 500 instead of their
+// own status code, as the homeserver would otherwise treat them as the answer to its query.
+func queryResultError(ok bool, err error) *Error {
+	switch {
+	case err == errQueryTimeout:
+		return &Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusGatewayTimeout,
+			Message:    "Timed out while processing query.",
+		}
+	case err != nil:
+		return &Error{
+			ErrorCode:  ErrUnknown,
+			HTTPStatus: http.StatusInternalServerError,
+			Message:    err.Error(),
+		}
+	case ok:
+		return nil
+	default:
+		return &Error{
+			ErrorCode:  ErrNotFound,
+			HTTPStatus: http.StatusNotFound,
+		}
+	}
+}
+
+// writeQueryResult writes the response to an alias or user query from the homeserver.
+func writeQueryResult(w http.ResponseWriter, err *Error) {
+	if err != nil {
+		err.Write(w)
+	} else {
+		WriteBlankOK(w)
+	}
+}
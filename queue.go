@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// queuePollInterval is how often the event channels are checked for free space when waiting for capacity.
+const queuePollInterval = 10 * time.Millisecond
+
+// QueueStats contains the current state of the event channels and counters of transactions that didn't fit in them.
+type QueueStats struct {
+	EventQueueDepth    int `json:"event_queue_depth"`
+	ToDeviceQueueDepth int `json:"to_device_queue_depth"`
+
+	// RefusedTransactions is the number of transactions that were refused because the channels were full.
+	RefusedTransactions uint64 `json:"refused_transactions"`
+}
+
+// QueueStats returns the current queue depths and the refused transaction count.
+func (as *AppService) QueueStats() QueueStats {
+	as.statsLock.Lock()
+	stats := as.queueStats
+	as.statsLock.Unlock()
+	stats.EventQueueDepth = len(as.Events)
+	stats.ToDeviceQueueDepth = len(as.ToDeviceEvents)
+	return stats
+}
+
+// queueTransaction pushes the events of a transaction into the event channels.
+// If QueueTimeout is set and there's no room for the events before it runs out, false is returned
+// and none of the events are queued. Once a transaction has been admitted, all of its events are queued,
+// even if that takes longer than QueueTimeout, so that acknowledged transactions never lose events.
+func (as *AppService) queueTransaction(eventList *EventList) bool {
+	as.queueLock.Lock()
+	defer as.queueLock.Unlock()
+
+	events := make([]*event.Event, 0, len(eventList.Events)+len(eventList.EphemeralEvents()))
+	events = append(events, eventList.Events...)
+	events = append(events, eventList.EphemeralEvents()...)
+	toDeviceEvents := eventList.ToDeviceEvents()
+
+	if as.QueueTimeout > 0 {
+		deadline := time.Now().Add(as.QueueTimeout)
+		if !waitForCapacity(as.Events, len(events), deadline) || !waitForCapacity(as.ToDeviceEvents, len(toDeviceEvents), deadline) {
+			as.statsLock.Lock()
+			as.queueStats.RefusedTransactions++
+			as.statsLock.Unlock()
+			return false
+		}
+	}
+	for _, evt := range events {
+		as.UpdateState(evt)
+		as.Events <- evt
+	}
+	for _, evt := range toDeviceEvents {
+		as.ToDeviceEvents <- evt
+	}
+	return true
+}
+
+// waitForCapacity waits until the channel has room for the given number of events, or for the whole channel
+// if there are more events than fit in it. Transactions are queued one at a time, so the space can't be taken
+// by anyone else after this returns.
+func waitForCapacity(ch chan *event.Event, count int, deadline time.Time) bool {
+	if count > cap(ch) {
+		count = cap(ch)
+	}
+	for cap(ch)-len(ch) < count {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(queuePollInterval)
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newQueueTestAppService(channelSize int, timeout time.Duration) *AppService {
+	as := Create()
+	as.Log = maulogger.Create()
+	as.Events = make(chan *event.Event, channelSize)
+	as.ToDeviceEvents = make(chan *event.Event, channelSize)
+	as.QueueTimeout = timeout
+	return as
+}
+
+func makeTestEvents(count int) []*event.Event {
+	events := make([]*event.Event, count)
+	for i := range events {
+		events[i] = &event.Event{
+			ID:     id.EventID(fmt.Sprintf("$%d", i)),
+			Type:   event.EventMessage,
+			RoomID: "!room:example.com",
+		}
+	}
+	return events
+}
+
+func TestQueueTransaction_OversizedWithSlowConsumer(t *testing.T) {
+	as := newQueueTestAppService(4, 20*time.Millisecond)
+	events := makeTestEvents(20)
+
+	received := make(chan *event.Event, len(events))
+	go func() {
+		for evt := range as.Events {
+			// Much slower than the queue timeout allows for the whole transaction.
+			time.Sleep(5 * time.Millisecond)
+			received <- evt
+		}
+	}()
+
+	if !as.queueTransaction(&EventList{Events: events}) {
+		t.Fatal("Transaction was refused even though the channel was empty")
+	}
+	for i, expected := range events {
+		select {
+		case evt := <-received:
+			if evt != expected {
+				t.Fatalf("Event %d was %s, expected %s", i, evt.ID, expected.ID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Only received %d of %d events of an accepted transaction", i, len(events))
+		}
+	}
+	if refused := as.QueueStats().RefusedTransactions; refused != 0 {
+		t.Errorf("Expected no refused transactions, got %d", refused)
+	}
+}
+
+func TestQueueTransaction_RefusedWhenFull(t *testing.T) {
+	as := newQueueTestAppService(4, 20*time.Millisecond)
+	if !as.queueTransaction(&EventList{Events: makeTestEvents(4)}) {
+		t.Fatal("Transaction that fits in the channel was refused")
+	}
+	if as.queueTransaction(&EventList{Events: makeTestEvents(8)}) {
+		t.Fatal("Transaction was accepted even though the channel stayed full")
+	}
+	if depth := len(as.Events); depth != 4 {
+		t.Errorf("Refused transaction changed the queue depth to %d", depth)
+	}
+	if refused := as.QueueStats().RefusedTransactions; refused != 1 {
+		t.Errorf("Expected one refused transaction, got %d", refused)
+	}
+}
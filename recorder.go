@@ -0,0 +1,177 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// RecordedTransaction is a single line in a transaction recording file.
+type RecordedTransaction struct {
+	TxnID     string          `json:"txn_id"`
+	Timestamp int64           `json:"timestamp"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// TransactionRecorder writes the raw bodies of received transactions into a JSONL file for debugging.
+// The file is rotated once it grows past MaxSize bytes, keeping at most MaxFiles old files
+// (named path.1, path.2 and so on, path.1 being the newest).
+//
+// All methods are safe to call on a nil *TransactionRecorder, which makes recording optional.
+type TransactionRecorder struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+
+	file *os.File
+	size int64
+	lock sync.Mutex
+}
+
+// NewTransactionRecorder creates a TransactionRecorder that appends to the file at the given path.
+func NewTransactionRecorder(path string, maxSize int64, maxFiles int) (*TransactionRecorder, error) {
+	rec := &TransactionRecorder{
+		Path:     path,
+		MaxSize:  maxSize,
+		MaxFiles: maxFiles,
+	}
+	err := rec.open()
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (rec *TransactionRecorder) open() error {
+	file, err := os.OpenFile(rec.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	rec.file = file
+	rec.size = info.Size()
+	return nil
+}
+
+func (rec *TransactionRecorder) rotate() error {
+	err := rec.file.Close()
+	if err != nil {
+		return err
+	}
+	if rec.MaxFiles > 0 {
+		_ = os.Remove(fmt.Sprintf("%s.%d", rec.Path, rec.MaxFiles))
+		for i := rec.MaxFiles - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", rec.Path, i), fmt.Sprintf("%s.%d", rec.Path, i+1))
+		}
+		err = os.Rename(rec.Path, rec.Path+".1")
+	} else {
+		err = os.Remove(rec.Path)
+	}
+	if err != nil {
+		return err
+	}
+	return rec.open()
+}
+
+// Record writes a transaction body into the recording file.
+func (rec *TransactionRecorder) Record(txnID string, body []byte) error {
+	if rec == nil {
+		return nil
+	}
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, body) != nil {
+		// Keep invalid bodies as strings so that they can be reproduced too
+		compacted.Reset()
+		data, _ := json.Marshal(string(body))
+		compacted.Write(data)
+	}
+	line, err := json.Marshal(&RecordedTransaction{
+		TxnID:     txnID,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Body:      compacted.Bytes(),
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.MaxSize > 0 && rec.size > 0 && rec.size+int64(len(line)) > rec.MaxSize {
+		err = rec.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := rec.file.Write(line)
+	rec.size += int64(n)
+	return err
+}
+
+// Close closes the recording file.
+func (rec *TransactionRecorder) Close() error {
+	if rec == nil {
+		return nil
+	}
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return rec.file.Close()
+}
+
+// ReplayRecording reads a file written by a TransactionRecorder and feeds the transactions in it through the same
+// parsing and state updating path as PutTransaction, dispatching the events to the given EventProcessor.
+//
+// Transactions that fail to parse are logged and skipped. The transaction store and journal are not touched.
+func (as *AppService) ReplayRecording(path string, ep *EventProcessor) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var txn RecordedTransaction
+		err = json.Unmarshal(scanner.Bytes(), &txn)
+		if err != nil {
+			as.Log.Warnln("Failed to parse line in transaction recording:", err)
+			continue
+		}
+		var eventList EventList
+		err = json.Unmarshal(txn.Body, &eventList)
+		if err != nil {
+			as.Log.Warnfln("Failed to parse JSON of recorded transaction %s: %v", txn.TxnID, err)
+			continue
+		}
+		as.Log.Debugfln("Replaying recorded transaction %s from %s", txn.TxnID, time.Unix(0, txn.Timestamp*int64(time.Millisecond)))
+		as.prepareEvents(eventList.Events, event.UnknownEventType)
+		as.prepareEvents(eventList.EphemeralEvents(), event.EphemeralEventType)
+		as.prepareEvents(eventList.ToDeviceEvents(), event.ToDeviceEventType)
+		for _, evt := range eventList.allEvents() {
+			if evt.Type.IsToDevice() {
+				ep.DispatchToDevice(evt)
+			} else {
+				as.UpdateState(evt)
+				ep.Dispatch(evt)
+			}
+		}
+	}
+	return scanner.Err()
+}
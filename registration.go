@@ -23,6 +23,11 @@ type Registration struct {
 	SenderLocalpart string     `yaml:"sender_localpart"`
 	RateLimited     bool       `yaml:"rate_limited"`
 	Namespaces      Namespaces `yaml:"namespaces"`
+	Protocols       []string   `yaml:"protocols,omitempty"`
+
+	EphemeralEvents     bool `yaml:"receive_ephemeral,omitempty"`
+	SoruEphemeralEvents bool `yaml:"de.sorunome.msc2409.push_ephemeral,omitempty"`
+	MSC3202             bool `yaml:"org.matrix.msc3202,omitempty"`
 }
 
 // CreateRegistration creates a Registration with random appservice and homeserver tokens.
@@ -0,0 +1,339 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// ErrorEventHandler is an event handler that can fail, e.g. when the remote network is unreachable.
+type ErrorEventHandler func(ctx context.Context, evt *event.Event) error
+
+// RetryPolicy decides how many times and how often a failed ErrorEventHandler is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of calls, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. It's multiplied by Multiplier after each retry.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// ShouldRetry can be used to give up immediately on errors that won't go away by retrying.
+	// If nil, all errors are retried.
+	ShouldRetry func(err error) bool
+}
+
+// DefaultRetryPolicy is a RetryPolicy with three attempts and exponential backoff.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 1 * time.Second,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+}
+
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+	backoff := policy.InitialBackoff
+	for i := 1; i < retry; i++ {
+		backoff = time.Duration(float64(backoff) * policy.Multiplier)
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			return policy.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+// DeadLetter is an event that a handler failed to handle even after retrying.
+type DeadLetter struct {
+	ID       string       `json:"id"`
+	Handler  string       `json:"handler"`
+	Event    *event.Event `json:"event"`
+	Error    string       `json:"error"`
+	Attempts int          `json:"attempts"`
+	FailedAt time.Time    `json:"failed_at"`
+}
+
+// DefaultDeadLetterLimit is the number of dead letters kept by the default in-memory DeadLetterStore.
+const DefaultDeadLetterLimit = 1000
+
+// DeadLetterStore stores events that handlers failed to handle, so that they can be inspected and replayed.
+type DeadLetterStore interface {
+	// Put adds a dead letter, or replaces the existing one with the same ID.
+	Put(letter *DeadLetter) error
+	Get(id string) (*DeadLetter, error)
+	List() ([]*DeadLetter, error)
+	Remove(id string) error
+}
+
+// ErrDeadLetterNotFound is returned by DeadLetterStores and replays when a dead letter doesn't exist.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// MemoryDeadLetterStore is a DeadLetterStore that keeps dead letters in memory.
+type MemoryDeadLetterStore struct {
+	// MaxSize is the maximum number of dead letters to keep. The oldest ones are removed first. Zero means no limit.
+	MaxSize int
+
+	letters map[string]*DeadLetter
+	lock    sync.RWMutex
+}
+
+// NewMemoryDeadLetterStore creates a MemoryDeadLetterStore that keeps at most the given number of dead letters.
+func NewMemoryDeadLetterStore(maxSize int) *MemoryDeadLetterStore {
+	return &MemoryDeadLetterStore{
+		MaxSize: maxSize,
+		letters: make(map[string]*DeadLetter),
+	}
+}
+
+func (store *MemoryDeadLetterStore) Put(letter *DeadLetter) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.letters[letter.ID] = letter
+	for store.MaxSize > 0 && len(store.letters) > store.MaxSize {
+		var oldest *DeadLetter
+		for _, existing := range store.letters {
+			if oldest == nil || existing.FailedAt.Before(oldest.FailedAt) {
+				oldest = existing
+			}
+		}
+		delete(store.letters, oldest.ID)
+	}
+	return nil
+}
+
+func (store *MemoryDeadLetterStore) Get(id string) (*DeadLetter, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	letter, ok := store.letters[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	return letter, nil
+}
+
+func (store *MemoryDeadLetterStore) List() ([]*DeadLetter, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	letters := make([]*DeadLetter, 0, len(store.letters))
+	for _, letter := range store.letters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+	return letters, nil
+}
+
+func (store *MemoryDeadLetterStore) Remove(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.letters, id)
+	return nil
+}
+
+// eventHolds keeps events from being marked as done while a handler is still retrying them in the background.
+type eventHolds struct {
+	holds    map[*event.Event]int
+	finished map[*event.Event]bool
+	lock     sync.Mutex
+}
+
+func (eh *eventHolds) hold(evt *event.Event) {
+	eh.lock.Lock()
+	defer eh.lock.Unlock()
+	if eh.holds == nil {
+		eh.holds = make(map[*event.Event]int)
+		eh.finished = make(map[*event.Event]bool)
+	}
+	eh.holds[evt]++
+}
+
+// deferDone returns true if the event is held, in which case it's marked as done when the last hold is released.
+func (eh *eventHolds) deferDone(evt *event.Event) bool {
+	eh.lock.Lock()
+	defer eh.lock.Unlock()
+	if eh.holds[evt] == 0 {
+		return false
+	}
+	eh.finished[evt] = true
+	return true
+}
+
+// release removes a hold and returns true if the event should now be marked as done.
+func (eh *eventHolds) release(evt *event.Event) bool {
+	eh.lock.Lock()
+	defer eh.lock.Unlock()
+	eh.holds[evt]--
+	if eh.holds[evt] > 0 {
+		return false
+	}
+	delete(eh.holds, evt)
+	finished := eh.finished[evt]
+	delete(eh.finished, evt)
+	return finished
+}
+
+type retryHandler struct {
+	name    string
+	policy  RetryPolicy
+	handler ErrorEventHandler
+}
+
+var errHandlerPanicked = errors.New("handler panicked")
+
+// attempt calls the handler once. A panic in the handler is returned as an error, so that it counts as a failed attempt.
+func (rh *retryHandler) attempt(ctx context.Context, evt *event.Event) (err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("%w: %v", errHandlerPanicked, panicErr)
+		}
+	}()
+	return rh.handler(ctx, evt)
+}
+
+func (rh *retryHandler) canRetry(attempt int, err error) bool {
+	return attempt < rh.policy.MaxAttempts && (rh.policy.ShouldRetry == nil || rh.policy.ShouldRetry(err))
+}
+
+// retry calls the handler again after a failed attempt until it succeeds or the retry policy runs out,
+// and returns the total number of attempts and the last error.
+func (rh *retryHandler) retry(ctx context.Context, evt *event.Event, attempt int, err error) (int, error) {
+	for err != nil && rh.canRetry(attempt, err) {
+		select {
+		case <-time.After(rh.policy.backoff(attempt)):
+		case <-ctx.Done():
+			return attempt, err
+		}
+		attempt++
+		err = rh.attempt(ctx, evt)
+	}
+	return attempt, err
+}
+
+// run calls the handler until it succeeds or the retry policy runs out, waiting for the backoff in between.
+func (rh *retryHandler) run(ctx context.Context, evt *event.Event) (int, error) {
+	return rh.retry(ctx, evt, 1, rh.attempt(ctx, evt))
+}
+
+func newDeadLetterID() string {
+	data := make([]byte, 8)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func (ep *EventProcessor) addRetryHandler(name string, policy RetryPolicy, handler ErrorEventHandler) EventHandler {
+	rh := &retryHandler{name: name, policy: policy, handler: handler}
+	ep.retryLock.Lock()
+	if _, ok := ep.retryHandlers[name]; ok {
+		ep.log.Warnfln("Handler name %s is used more than once, dead letters will be replayed to the last one", name)
+	}
+	ep.retryHandlers[name] = rh
+	ep.retryLock.Unlock()
+	return func(ctx context.Context, evt *event.Event) {
+		err := rh.attempt(ctx, evt)
+		if err == nil {
+			return
+		} else if !rh.canRetry(1, err) {
+			ep.deadLetter(&DeadLetter{ID: newDeadLetterID(), Handler: name, Event: evt}, 1, err)
+			return
+		}
+		// Wait for the retries in the background, so that the backoff doesn't block the handlers of other events.
+		// The event isn't marked as done in the journal and transaction hooks until the retries are over.
+		ep.as.eventHolds.hold(evt)
+		go func() {
+			attempts, err := rh.retry(ctx, evt, 1, err)
+			if err != nil {
+				ep.deadLetter(&DeadLetter{ID: newDeadLetterID(), Handler: name, Event: evt}, attempts, err)
+			}
+			if ep.as.eventHolds.release(evt) {
+				ep.as.markEventDone(evt)
+			}
+		}()
+	}
+}
+
+func (ep *EventProcessor) deadLetter(letter *DeadLetter, attempts int, err error) {
+	ep.log.Errorfln("Handler %s failed to handle %s after %d attempts: %v", letter.Handler, letter.Event.ID, attempts, err)
+	if ep.as.DeadLetters == nil {
+		return
+	}
+	updated := *letter
+	updated.Error = err.Error()
+	updated.Attempts += attempts
+	updated.FailedAt = time.Now()
+	storeErr := ep.as.DeadLetters.Put(&updated)
+	if storeErr != nil {
+		ep.log.Errorfln("Failed to store dead letter for %s: %v", letter.Event.ID, storeErr)
+	}
+}
+
+// OnWithRetry registers an error-returning handler that is retried according to the given policy.
+// If the handler still fails after the retries, the event is put into the DeadLetterStore of the appservice.
+// Panics in the handler count as failed attempts.
+//
+// Only the first attempt is made in the dispatch path. Retries happen in the background, and the event is only
+// marked as done in the Journal and transaction hooks after the handler succeeds or the event is dead-lettered.
+//
+// Retried events lose their ordering: even in the RoomOrdered and WorkerPool modes, the handlers of later events
+// in the same room run while a failed event is waiting for its retry. Middlewares only apply to the first attempt.
+//
+// The name identifies the handler when dead letters are replayed, so it must be unique and stay the same
+// across restarts if the dead letters are persisted.
+func (ep *EventProcessor) OnWithRetry(evtType event.Type, name string, policy RetryPolicy, handler ErrorEventHandler) {
+	ep.OnContext(evtType, ep.addRetryHandler(name, policy, handler))
+}
+
+// OnToDeviceWithRetry registers an error-returning to-device event handler like OnWithRetry.
+func (ep *EventProcessor) OnToDeviceWithRetry(evtType event.Type, name string, policy RetryPolicy, handler ErrorEventHandler) {
+	ep.OnToDeviceContext(evtType, ep.addRetryHandler(name, policy, handler))
+}
+
+// ReplayDeadLetter calls the handler of a dead letter again with the same retry policy.
+// The dead letter is removed if the handler succeeds and updated if it fails again.
+func (ep *EventProcessor) ReplayDeadLetter(ctx context.Context, letter *DeadLetter) error {
+	ep.retryLock.RLock()
+	rh, ok := ep.retryHandlers[letter.Handler]
+	ep.retryLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("handler %s is not registered", letter.Handler)
+	}
+	attempts, err := rh.run(ctx, letter.Event)
+	if err != nil {
+		ep.deadLetter(letter, attempts, err)
+		return err
+	} else if ep.as.DeadLetters == nil {
+		return nil
+	}
+	return ep.as.DeadLetters.Remove(letter.ID)
+}
+
+// ReplayDeadLetter replays the dead letter with the given ID in the running event processor that has its handler.
+func (as *AppService) ReplayDeadLetter(ctx context.Context, id string) error {
+	if as.DeadLetters == nil {
+		return ErrDeadLetterNotFound
+	}
+	letter, err := as.DeadLetters.Get(id)
+	if err != nil {
+		return err
+	}
+	for _, ep := range as.processors.list() {
+		ep.retryLock.RLock()
+		_, ok := ep.retryHandlers[letter.Handler]
+		ep.retryLock.RUnlock()
+		if ok {
+			return ep.ReplayDeadLetter(ctx, letter)
+		}
+	}
+	return fmt.Errorf("no running event processor has the handler %s", letter.Handler)
+}
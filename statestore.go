@@ -36,15 +36,49 @@ type StateStore interface {
 	HasPowerLevel(roomID id.RoomID, userID id.UserID, eventType event.Type) bool
 }
 
+// RoomStateDumper is an optional interface for state stores that can list the cached state of a room.
+type RoomStateDumper interface {
+	DumpRoomMembers(roomID id.RoomID) map[id.UserID]*event.MemberEventContent
+	GetTypingUsers(roomID id.RoomID) []id.UserID
+}
+
+// TypingUsersSetter is an optional interface for state stores that can replace the whole list of typing users
+// in a room at once. If a state store doesn't implement it, SetTyping is used for each user instead.
+type TypingUsersSetter interface {
+	SetTypingUsers(roomID id.RoomID, userIDs []id.UserID, timeout int64)
+}
+
+// setTypingUsers replaces the list of typing users in a room, using SetTypingUsers if the state store has it.
+func (as *AppService) setTypingUsers(roomID id.RoomID, userIDs []id.UserID, timeout int64) {
+	if setter, ok := as.StateStore.(TypingUsersSetter); ok {
+		setter.SetTypingUsers(roomID, userIDs, timeout)
+		return
+	}
+	if dumper, ok := as.StateStore.(RoomStateDumper); ok {
+		for _, userID := range dumper.GetTypingUsers(roomID) {
+			as.StateStore.SetTyping(roomID, userID, -1)
+		}
+	}
+	for _, userID := range userIDs {
+		as.StateStore.SetTyping(roomID, userID, timeout)
+	}
+}
+
 func (as *AppService) UpdateState(evt *event.Event) {
 	switch content := evt.Content.Parsed.(type) {
 	case *event.MemberEventContent:
 		as.StateStore.SetMember(evt.RoomID, id.UserID(evt.GetStateKey()), content)
 	case *event.PowerLevelsEventContent:
 		as.StateStore.SetPowerLevels(evt.RoomID, content)
+	case *event.TypingEventContent:
+		as.setTypingUsers(evt.RoomID, content.UserIDs, pushedTypingTimeout)
 	}
 }
 
+// pushedTypingTimeout is the timeout in seconds used for typing notifications pushed by the homeserver,
+// as the homeserver only tells which users are typing, not for how long.
+const pushedTypingTimeout = 30
+
 type TypingStateStore struct {
 	typing     map[id.RoomID]map[id.UserID]int64
 	typingLock sync.RWMutex
@@ -89,6 +123,36 @@ func (store *TypingStateStore) SetTyping(roomID id.RoomID, userID id.UserID, tim
 	store.typing[roomID] = roomTyping
 }
 
+// SetTypingUsers replaces the list of users who are typing in the given room.
+func (store *TypingStateStore) SetTypingUsers(roomID id.RoomID, userIDs []id.UserID, timeout int64) {
+	store.typingLock.Lock()
+	defer store.typingLock.Unlock()
+	if len(userIDs) == 0 {
+		delete(store.typing, roomID)
+		return
+	}
+	typingEndsAt := time.Now().Unix() + timeout
+	roomTyping := make(map[id.UserID]int64, len(userIDs))
+	for _, userID := range userIDs {
+		roomTyping[userID] = typingEndsAt
+	}
+	store.typing[roomID] = roomTyping
+}
+
+// GetTypingUsers returns the users who are currently typing in the given room.
+func (store *TypingStateStore) GetTypingUsers(roomID id.RoomID) []id.UserID {
+	store.typingLock.RLock()
+	defer store.typingLock.RUnlock()
+	now := time.Now().Unix()
+	var userIDs []id.UserID
+	for userID, typingEndsAt := range store.typing[roomID] {
+		if typingEndsAt >= now {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
 type BasicStateStore struct {
 	registrationsLock sync.RWMutex                                          `json:"-"`
 	Registrations     map[id.UserID]bool                                    `json:"registrations"`
@@ -135,6 +199,17 @@ func (store *BasicStateStore) GetRoomMembers(roomID id.RoomID) map[id.UserID]*ev
 	return members
 }
 
+// DumpRoomMembers returns a copy of the cached members of the given room.
+func (store *BasicStateStore) DumpRoomMembers(roomID id.RoomID) map[id.UserID]*event.MemberEventContent {
+	store.membersLock.RLock()
+	defer store.membersLock.RUnlock()
+	members := make(map[id.UserID]*event.MemberEventContent, len(store.Members[roomID]))
+	for userID, member := range store.Members[roomID] {
+		members[userID] = member
+	}
+	return members
+}
+
 func (store *BasicStateStore) GetMembership(roomID id.RoomID, userID id.UserID) event.Membership {
 	return store.GetMember(roomID, userID).Membership
 }
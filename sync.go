@@ -0,0 +1,178 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"errors"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// SyncTimeout is the long-polling timeout in milliseconds used for /sync requests.
+var SyncTimeout = 30000
+
+// SyncFilter is the filter that is uploaded for the sync loop if the config doesn't have a filter ID yet.
+var SyncFilter = &mautrix.Filter{
+	EventFormat: mautrix.EventFormatClient,
+	Room: mautrix.RoomFilter{
+		Timeline: mautrix.FilterPart{
+			Limit: 50,
+		},
+	},
+}
+
+const maxSyncBackoff = 60 * time.Second
+
+// syncQueueFullDelay is how long the sync loop waits before retrying a batch that didn't fit in the event queue.
+const syncQueueFullDelay = 5 * time.Second
+
+// errSyncQueueFull means that the batch didn't fit in the event queue and has to be requested again.
+var errSyncQueueFull = errors.New("event queue is full")
+
+// StartSync receives events by running a /sync loop as the appservice bot, for homeservers that can't push
+// transactions to the appservice. It does nothing unless sync is enabled in the config.
+//
+// The events are fed into the event channels like pushed transactions. The next_batch token is saved into the
+// config after each batch, and the config file is rewritten if the config was loaded with Load.
+// The loop runs until the appservice is stopped.
+func (as *AppService) StartSync() {
+	if !as.Sync.Enabled {
+		return
+	}
+	ctx := as.Context()
+	bot := as.BotIntent().WithContext(ctx)
+	log := as.Log.Sub("Sync")
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := as.syncOnce(bot)
+		if err == nil {
+			backoff = time.Second
+			continue
+		} else if ctx.Err() != nil {
+			break
+		} else if err == errSyncQueueFull {
+			// The homeserver is fine, so wait for the handlers to catch up without growing the backoff.
+			// The next_batch token wasn't advanced, so the same batch is requested again.
+			log.Debugfln("Event queue is full, retrying the batch in %s", syncQueueFullDelay)
+			select {
+			case <-time.After(syncQueueFullDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		log.Warnfln("Sync failed: %v, retrying in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+		if backoff > maxSyncBackoff {
+			backoff = maxSyncBackoff
+		}
+	}
+	log.Debugln("Sync loop stopped")
+}
+
+func (as *AppService) syncOnce(bot *IntentAPI) error {
+	if len(as.Sync.FilterID) == 0 {
+		err := bot.EnsureRegistered()
+		if err != nil {
+			return err
+		}
+		resp, err := bot.CreateFilter(SyncFilter)
+		if err != nil {
+			return err
+		}
+		as.saveSyncState(func() {
+			as.Sync.FilterID = resp.FilterID
+		})
+	}
+	since := as.Sync.NextBatch
+	resp, err := bot.SyncRequest(SyncTimeout, since, as.Sync.FilterID, false, event.PresenceOffline)
+	if err != nil {
+		return err
+	}
+	err = as.handleSyncResponse(resp, since)
+	if err != nil {
+		// Request the same batch again.
+		return err
+	}
+	if since != resp.NextBatch {
+		as.saveSyncState(func() {
+			as.Sync.NextBatch = resp.NextBatch
+		})
+	}
+	return nil
+}
+
+// saveSyncState applies the given change to the sync config and saves the config file if it was loaded with Load.
+func (as *AppService) saveSyncState(update func()) {
+	as.saveLock.Lock()
+	defer as.saveLock.Unlock()
+	update()
+	if len(as.configPath) == 0 {
+		return
+	}
+	err := as.save(as.configPath)
+	if err != nil {
+		as.Log.Warnln("Failed to save sync state to config:", err)
+	}
+}
+
+func setRoomID(roomID id.RoomID, evts []*event.Event) []*event.Event {
+	for _, evt := range evts {
+		evt.RoomID = roomID
+	}
+	return evts
+}
+
+// handleSyncResponse feeds the events of a sync response into the event channels.
+// For the initial sync, only the state store is updated, so that old events aren't handled as new ones.
+//
+// Other batches go through the same path as pushed transactions, with the since token as the transaction ID,
+// so they're journaled, passed to transaction hooks and not handled twice if the next_batch token isn't saved.
+func (as *AppService) handleSyncResponse(resp *mautrix.RespSync, since string) error {
+	var eventList EventList
+	for roomID, room := range resp.Rooms.Join {
+		eventList.Events = append(eventList.Events, setRoomID(roomID, room.State.Events)...)
+		eventList.Events = append(eventList.Events, setRoomID(roomID, room.Timeline.Events)...)
+		eventList.Ephemeral = append(eventList.Ephemeral, setRoomID(roomID, room.Ephemeral.Events)...)
+	}
+	for roomID, room := range resp.Rooms.Invite {
+		eventList.Events = append(eventList.Events, setRoomID(roomID, room.State.Events)...)
+	}
+	for roomID, room := range resp.Rooms.Leave {
+		eventList.Events = append(eventList.Events, setRoomID(roomID, room.State.Events)...)
+		eventList.Events = append(eventList.Events, setRoomID(roomID, room.Timeline.Events)...)
+	}
+	eventList.Ephemeral = append(eventList.Ephemeral, resp.Presence.Events...)
+	eventList.ToDevice = resp.ToDevice.Events
+	if len(resp.DeviceLists.Changed) > 0 || len(resp.DeviceLists.Left) > 0 {
+		eventList.DeviceLists = &DeviceLists{
+			Changed: resp.DeviceLists.Changed,
+			Left:    resp.DeviceLists.Left,
+		}
+	}
+
+	if len(since) == 0 {
+		as.prepareEvents(eventList.Events, event.UnknownEventType)
+		for _, evt := range eventList.Events {
+			as.UpdateState(evt)
+		}
+		return nil
+	}
+	respErr := as.processTransaction(as.Context(), "sync:"+since, &eventList)
+	if respErr == nil {
+		return nil
+	} else if respErr.ErrorCode == ErrQueueFull {
+		return errSyncQueueFull
+	}
+	return errors.New(respErr.Message)
+}
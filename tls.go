@@ -0,0 +1,186 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// TLSReloadInterval is how often the certificate files are checked for changes.
+var TLSReloadInterval = 1 * time.Minute
+
+// tlsReloader provides the TLS config of the HTTP server and reloads the certificates when the files change.
+type tlsReloader struct {
+	host *HostConfig
+	log  log.Logger
+	base *tls.Config
+
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+	lock     sync.RWMutex
+}
+
+func newTLSReloader(host *HostConfig, logger log.Logger) (*tlsReloader, error) {
+	reloader := &tlsReloader{
+		host:     host,
+		log:      logger,
+		modTimes: make(map[string]time.Time),
+	}
+	reloader.base = &tls.Config{
+		NextProtos:         []string{"h2", "http/1.1"},
+		GetCertificate:     reloader.GetCertificate,
+		GetConfigForClient: reloader.GetConfigForClient,
+	}
+	return reloader, reloader.reload()
+}
+
+// changed checks if any of the certificate files have been modified since they were last loaded.
+func (reloader *tlsReloader) changed() bool {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+	for _, path := range []string{reloader.host.TLSCert, reloader.host.TLSKey, reloader.host.TLSClientCA} {
+		if len(path) == 0 {
+			continue
+		}
+		stat, err := os.Stat(path)
+		if err != nil || !stat.ModTime().Equal(reloader.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (reloader *tlsReloader) reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{reloader.host.TLSCert, reloader.host.TLSKey, reloader.host.TLSClientCA} {
+		if len(path) == 0 {
+			continue
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = stat.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(reloader.host.TLSCert, reloader.host.TLSKey)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	var clientCA *x509.CertPool
+	if len(reloader.host.TLSClientCA) > 0 {
+		data, err := ioutil.ReadFile(reloader.host.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA bundle: %w", err)
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(data) {
+			return errors.New("client CA bundle doesn't contain any certificates")
+		}
+	}
+	reloader.lock.Lock()
+	reloader.cert = &cert
+	reloader.clientCA = clientCA
+	reloader.modTimes = modTimes
+	reloader.lock.Unlock()
+	return nil
+}
+
+// watch reloads the certificates every TLSReloadInterval if the files have changed, until the stop channel is closed.
+// If reloading fails, the previously loaded certificates are kept.
+func (reloader *tlsReloader) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(TLSReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !reloader.changed() {
+				continue
+			}
+			err := reloader.reload()
+			if err != nil {
+				reloader.log.Warnln("Failed to reload TLS certificates:", err)
+			} else {
+				reloader.log.Infoln("Reloaded TLS certificates")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// GetCertificate returns the server certificate.
+func (reloader *tlsReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+	return reloader.cert, nil
+}
+
+// GetConfigForClient returns the TLS config for a new connection, which is the base config with the current
+// client CA bundle. Client certificates are optional at the TLS level, as only the homeserver routes require them.
+func (reloader *tlsReloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	reloader.lock.RLock()
+	clientCA := reloader.clientCA
+	reloader.lock.RUnlock()
+	config := reloader.base.Clone()
+	config.GetConfigForClient = nil
+	if clientCA != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = clientCA
+	}
+	return config, nil
+}
+
+type clientCertHostKey struct{}
+
+// requireClientCerts makes the client certificate settings of the given host config available to CheckServerToken.
+func requireClientCerts(next http.Handler, host *HostConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientCertHostKey{}, host)))
+	})
+}
+
+// checkClientCert checks that the request was made with a verified client certificate that has one of the
+// allowed subjects, if the listener that received the request has client certificate verification enabled.
+func checkClientCert(r *http.Request) error {
+	host, ok := r.Context().Value(clientCertHostKey{}).(*HostConfig)
+	if !ok || len(host.TLSClientCA) == 0 {
+		return nil
+	} else if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return errors.New("no client certificate")
+	} else if len(host.TLSAllowedSubjects) == 0 {
+		return nil
+	}
+	for _, chain := range r.TLS.VerifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		cert := chain[0]
+		for _, allowed := range host.TLSAllowedSubjects {
+			if allowed == cert.Subject.CommonName || allowed == cert.Subject.String() {
+				return nil
+			}
+			for _, name := range cert.DNSNames {
+				if allowed == name {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("client certificate subject is not allowed")
+}
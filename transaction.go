@@ -0,0 +1,157 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// Transaction is a single transaction pushed by the homeserver, passed to transaction hooks.
+type Transaction struct {
+	ID     string
+	Events *EventList
+	// Context is cancelled when the homeserver stops waiting for the response to the transaction.
+	Context context.Context
+	// Failed contains the events whose handlers weren't called, e.g. because they were dropped from a full
+	// worker pool queue. It's only filled for end hooks.
+	Failed []*event.Event
+
+	remaining int
+	endErr    error
+	done      chan struct{}
+}
+
+// TransactionHook is a function that is called with a whole transaction.
+//
+// Errors returned from hooks are sent to the homeserver, which will retry the transaction later.
+type TransactionHook func(txn *Transaction) error
+
+type transactionHooks struct {
+	start  []TransactionHook
+	end    []TransactionHook
+	events map[*event.Event]*Transaction
+	lock   sync.Mutex
+}
+
+// OnTransactionStart registers a hook that is called when a transaction is received, before its events are
+// dispatched. If the hook returns an error, the events are not dispatched.
+func (as *AppService) OnTransactionStart(hook TransactionHook) {
+	as.txnHooks.lock.Lock()
+	as.txnHooks.start = append(as.txnHooks.start, hook)
+	as.txnHooks.lock.Unlock()
+}
+
+// OnTransactionEnd registers a hook that is called after the event handlers have returned for all the events
+// in a transaction. The transaction isn't acknowledged to the homeserver until all end hooks have returned.
+func (as *AppService) OnTransactionEnd(hook TransactionHook) {
+	as.txnHooks.lock.Lock()
+	as.txnHooks.end = append(as.txnHooks.end, hook)
+	as.txnHooks.lock.Unlock()
+}
+
+// TransactionOf returns the transaction that the given event was received in,
+// or nil if the event isn't being tracked (i.e. there are no end hooks or the event is already done).
+func (as *AppService) TransactionOf(evt *event.Event) *Transaction {
+	as.txnHooks.lock.Lock()
+	defer as.txnHooks.lock.Unlock()
+	return as.txnHooks.events[evt]
+}
+
+func (as *AppService) startTransaction(ctx context.Context, txnID string, eventList *EventList) (*Transaction, error) {
+	txn := &Transaction{
+		ID:      txnID,
+		Events:  eventList,
+		Context: ctx,
+		done:    make(chan struct{}),
+	}
+	as.txnHooks.lock.Lock()
+	startHooks := as.txnHooks.start
+	trackEvents := len(as.txnHooks.end) > 0
+	as.txnHooks.lock.Unlock()
+
+	for _, hook := range startHooks {
+		err := hook(txn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !trackEvents {
+		close(txn.done)
+		return txn, nil
+	}
+	events := eventList.allEvents()
+	if len(events) == 0 {
+		go as.endTransaction(txn)
+		return txn, nil
+	}
+	as.txnHooks.lock.Lock()
+	if as.txnHooks.events == nil {
+		as.txnHooks.events = make(map[*event.Event]*Transaction)
+	}
+	for _, evt := range events {
+		as.txnHooks.events[evt] = txn
+	}
+	txn.remaining = len(events)
+	as.txnHooks.lock.Unlock()
+	return txn, nil
+}
+
+// forgetTransaction stops tracking the events of a transaction that won't be dispatched after all.
+func (as *AppService) forgetTransaction(txn *Transaction) {
+	as.txnHooks.lock.Lock()
+	defer as.txnHooks.lock.Unlock()
+	for evt, evtTxn := range as.txnHooks.events {
+		if evtTxn == txn {
+			delete(as.txnHooks.events, evt)
+		}
+	}
+}
+
+func (as *AppService) transactionEventDone(evt *event.Event) {
+	as.finishTransactionEvent(evt, false)
+}
+
+// transactionEventFailed counts an event of a transaction as finished without it having been handled.
+func (as *AppService) transactionEventFailed(evt *event.Event) {
+	as.finishTransactionEvent(evt, true)
+}
+
+func (as *AppService) finishTransactionEvent(evt *event.Event, failed bool) {
+	as.txnHooks.lock.Lock()
+	txn, ok := as.txnHooks.events[evt]
+	if !ok {
+		as.txnHooks.lock.Unlock()
+		return
+	}
+	delete(as.txnHooks.events, evt)
+	if failed {
+		txn.Failed = append(txn.Failed, evt)
+	}
+	txn.remaining--
+	finished := txn.remaining == 0
+	as.txnHooks.lock.Unlock()
+	if finished {
+		as.endTransaction(txn)
+	}
+}
+
+func (as *AppService) endTransaction(txn *Transaction) {
+	as.txnHooks.lock.Lock()
+	endHooks := as.txnHooks.end
+	as.txnHooks.lock.Unlock()
+	for _, hook := range endHooks {
+		err := hook(txn)
+		if err != nil {
+			txn.endErr = err
+			break
+		}
+	}
+	close(txn.done)
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTransactionRetention is how long processed transaction IDs are remembered by default.
+var DefaultTransactionRetention = 24 * time.Hour
+
+// TransactionStore remembers which transactions from the homeserver have already been processed,
+// so that retried transactions are not dispatched twice.
+type TransactionStore interface {
+	IsProcessed(txnID string) (bool, error)
+	MarkProcessed(txnID string) error
+}
+
+// transactionPruneInterval is how often expired transaction IDs are removed from memory.
+const transactionPruneInterval = time.Minute
+
+// MemoryTransactionStore is a TransactionStore that only keeps transaction IDs in memory.
+type MemoryTransactionStore struct {
+	Retention time.Duration
+
+	processed     map[string]time.Time
+	processedLock sync.RWMutex
+	lastPrune     time.Time
+}
+
+// NewMemoryTransactionStore creates a MemoryTransactionStore that forgets transactions after the given duration.
+func NewMemoryTransactionStore(retention time.Duration) *MemoryTransactionStore {
+	return &MemoryTransactionStore{
+		Retention: retention,
+		processed: make(map[string]time.Time),
+	}
+}
+
+func (store *MemoryTransactionStore) IsProcessed(txnID string) (bool, error) {
+	store.processedLock.RLock()
+	defer store.processedLock.RUnlock()
+	processedAt, ok := store.processed[txnID]
+	return ok && time.Since(processedAt) < store.Retention, nil
+}
+
+func (store *MemoryTransactionStore) MarkProcessed(txnID string) error {
+	store.processedLock.Lock()
+	defer store.processedLock.Unlock()
+	store.processed[txnID] = time.Now()
+	store.prune(false)
+	return nil
+}
+
+// prune removes expired transaction IDs. Unless forced, it only does anything once per transactionPruneInterval,
+// so that marking transactions as processed doesn't have to go through all of them every time.
+func (store *MemoryTransactionStore) prune(force bool) {
+	if !force && time.Since(store.lastPrune) < transactionPruneInterval {
+		return
+	}
+	store.lastPrune = time.Now()
+	for txnID, processedAt := range store.processed {
+		if time.Since(processedAt) >= store.Retention {
+			delete(store.processed, txnID)
+		}
+	}
+}
+
+// FileTransactionStore is a TransactionStore that persists transaction IDs into a file.
+//
+// Processed transactions are appended to the file as JSON lines. The file is compacted by rewriting it
+// with only the unexpired transactions when most of its lines are expired.
+type FileTransactionStore struct {
+	*MemoryTransactionStore
+	Path string
+
+	file  *os.File
+	lines int
+}
+
+type fileTransactionEntry struct {
+	TxnID       string `json:"txn_id"`
+	ProcessedAt int64  `json:"ts"`
+}
+
+// fileCompactionThreshold is the minimum number of lines in the file of a FileTransactionStore before it's compacted.
+const fileCompactionThreshold = 1000
+
+// NewFileTransactionStore creates a FileTransactionStore and loads any previously saved transaction IDs from the given path.
+func NewFileTransactionStore(path string, retention time.Duration) (*FileTransactionStore, error) {
+	store := &FileTransactionStore{
+		MemoryTransactionStore: NewMemoryTransactionStore(retention),
+		Path:                   path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var entry fileTransactionEntry
+		if len(line) == 0 || json.Unmarshal(line, &entry) != nil {
+			continue
+		}
+		store.processed[entry.TxnID] = time.Unix(0, entry.ProcessedAt*int64(time.Millisecond))
+		store.lines++
+	}
+	store.prune(true)
+	if store.needsCompaction() {
+		err = store.compact()
+	} else {
+		store.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *FileTransactionStore) needsCompaction() bool {
+	return store.lines >= fileCompactionThreshold && store.lines > 2*len(store.processed)
+}
+
+func marshalTransactionEntry(txnID string, processedAt time.Time) ([]byte, error) {
+	data, err := json.Marshal(&fileTransactionEntry{
+		TxnID:       txnID,
+		ProcessedAt: processedAt.UnixNano() / int64(time.Millisecond),
+	})
+	return append(data, '\n'), err
+}
+
+// compact rewrites the file with only the unexpired transaction IDs and reopens it for appending.
+func (store *FileTransactionStore) compact() error {
+	var buf bytes.Buffer
+	for txnID, processedAt := range store.processed {
+		line, err := marshalTransactionEntry(txnID, processedAt)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+	}
+	tempPath := store.Path + ".tmp"
+	err := ioutil.WriteFile(tempPath, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempPath, store.Path)
+	if err != nil {
+		return err
+	}
+	if store.file != nil {
+		_ = store.file.Close()
+	}
+	store.file, err = os.OpenFile(store.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	store.lines = len(store.processed)
+	return err
+}
+
+func (store *FileTransactionStore) MarkProcessed(txnID string) error {
+	store.processedLock.Lock()
+	defer store.processedLock.Unlock()
+	now := time.Now()
+	store.processed[txnID] = now
+	store.prune(false)
+
+	line, err := marshalTransactionEntry(txnID, now)
+	if err != nil {
+		return err
+	}
+	_, err = store.file.Write(line)
+	if err != nil {
+		return err
+	}
+	store.lines++
+	if store.needsCompaction() {
+		return store.compact()
+	}
+	return nil
+}
+
+// Close closes the file of the store.
+func (store *FileTransactionStore) Close() error {
+	store.processedLock.Lock()
+	defer store.processedLock.Unlock()
+	return store.file.Close()
+}
+
+// SQLTransactionStore is a TransactionStore that stores transaction IDs in an SQL database.
+// The queries work with both PostgreSQL and SQLite 3.24+.
+type SQLTransactionStore struct {
+	DB        *sql.DB
+	Retention time.Duration
+
+	lastPrune time.Time
+	pruneLock sync.Mutex
+}
+
+// NewSQLTransactionStore creates a SQLTransactionStore and makes sure the table for transaction IDs exists.
+func NewSQLTransactionStore(db *sql.DB, retention time.Duration) (*SQLTransactionStore, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS appservice_txn (
+		txn_id       TEXT   PRIMARY KEY,
+		processed_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS appservice_txn_processed_at_idx ON appservice_txn (processed_at)")
+	if err != nil {
+		return nil, err
+	}
+	return &SQLTransactionStore{
+		DB:        db,
+		Retention: retention,
+	}, nil
+}
+
+func (store *SQLTransactionStore) cutoff() int64 {
+	return time.Now().Add(-store.Retention).UnixNano() / int64(time.Millisecond)
+}
+
+func (store *SQLTransactionStore) IsProcessed(txnID string) (bool, error) {
+	var count int
+	err := store.DB.QueryRow("SELECT COUNT(*) FROM appservice_txn WHERE txn_id=$1 AND processed_at>$2", txnID, store.cutoff()).Scan(&count)
+	return count > 0, err
+}
+
+func (store *SQLTransactionStore) MarkProcessed(txnID string) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	_, err := store.DB.Exec(`INSERT INTO appservice_txn (txn_id, processed_at) VALUES ($1, $2)
+		ON CONFLICT (txn_id) DO UPDATE SET processed_at=excluded.processed_at`, txnID, now)
+	if err != nil {
+		return err
+	}
+	return store.prune()
+}
+
+// prune deletes expired transaction IDs, at most once per transactionPruneInterval.
+func (store *SQLTransactionStore) prune() error {
+	store.pruneLock.Lock()
+	defer store.pruneLock.Unlock()
+	if time.Since(store.lastPrune) < transactionPruneInterval {
+		return nil
+	}
+	store.lastPrune = time.Now()
+	_, err := store.DB.Exec("DELETE FROM appservice_txn WHERE processed_at<=$1", store.cutoff())
+	return err
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// Websocket commands
+const (
+	WebsocketCommandTransaction = "transaction"
+	WebsocketCommandQueryAlias  = "query_alias"
+	WebsocketCommandQueryUser   = "query_user"
+	WebsocketCommandResponse    = "response"
+)
+
+// WebsocketRequest is a transaction or query sent to the appservice over the websocket transport.
+type WebsocketRequest struct {
+	ID      int             `json:"id"`
+	Command string          `json:"command"`
+	TxnID   string          `json:"txn_id,omitempty"`
+	Alias   string          `json:"alias,omitempty"`
+	UserID  id.UserID       `json:"user_id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// WebsocketResponse is the response to a WebsocketRequest. The status and data are the same as the
+// status code and body of the equivalent HTTP response.
+type WebsocketResponse struct {
+	ID      int         `json:"id"`
+	Command string      `json:"command"`
+	Status  int         `json:"status"`
+	Data    interface{} `json:"data"`
+}
+
+const maxWebsocketBackoff = 60 * time.Second
+
+const (
+	// websocketPingInterval is how often pings are sent to the websocket proxy.
+	websocketPingInterval = 30 * time.Second
+	// websocketReadTimeout is how long the connection may stay silent before it's considered dead.
+	// Pongs reset the timeout, so it only expires if the proxy stops answering pings.
+	websocketReadTimeout = 2 * websocketPingInterval
+)
+
+type websocketConn struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+}
+
+func (wc *websocketConn) respond(req *WebsocketRequest, respErr *Error) error {
+	resp := WebsocketResponse{
+		ID:      req.ID,
+		Command: WebsocketCommandResponse,
+		Status:  http.StatusOK,
+		Data:    struct{}{},
+	}
+	if respErr != nil {
+		resp.Status = respErr.HTTPStatus
+		resp.Data = respErr
+	}
+	wc.writeLock.Lock()
+	defer wc.writeLock.Unlock()
+	return wc.conn.WriteJSON(&resp)
+}
+
+// StartWebsocket receives transactions and queries by connecting to a websocket proxy, for setups where the
+// homeserver can't reach the appservice directly. It does nothing unless the websocket transport is enabled
+// in the config.
+//
+// The connection is authenticated with the as_token. Each request is handled like the equivalent HTTP request
+// and answered with a response that has the same ID. Transactions are handled in order and only acknowledged
+// after they've been processed, so the proxy is expected to resend unacknowledged transactions after a reconnect.
+// Resent transactions that were already processed are deduplicated using the TransactionStore.
+// The connection is reestablished with backoff until the appservice is stopped.
+func (as *AppService) StartWebsocket() {
+	if !as.Websocket.Enabled {
+		return
+	}
+	ctx := as.Context()
+	log := as.Log.Sub("Websocket")
+	backoff := time.Second
+	for ctx.Err() == nil {
+		connected, err := as.runWebsocket(ctx)
+		if connected {
+			backoff = time.Second
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		log.Warnfln("Websocket connection failed: %v, reconnecting in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+		if backoff > maxWebsocketBackoff {
+			backoff = maxWebsocketBackoff
+		}
+	}
+	log.Debugln("Websocket transport stopped")
+}
+
+// runWebsocket connects to the websocket proxy and handles requests until the connection is closed.
+// Requests that are still being processed are finished before returning, so that a resent transaction
+// isn't handled while the original is still in progress.
+func (as *AppService) runWebsocket(ctx context.Context) (bool, error) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+as.Registration.AppToken)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, as.Websocket.URL, header)
+	if err != nil {
+		return false, err
+	}
+	as.Log.Infoln("Connected to websocket at", as.Websocket.URL)
+	wc := &websocketConn{conn: conn}
+
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(websocketReadTimeout))
+	})
+	closed := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(websocketPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketPingInterval))
+				if err != nil {
+					as.Log.Debugln("Failed to send websocket ping:", err)
+				}
+			case <-ctx.Done():
+				_ = conn.Close()
+				return
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	transactions := make(chan *WebsocketRequest, 16)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for req := range transactions {
+			as.handleWebsocketRequest(ctx, wc, req)
+		}
+	}()
+
+	for {
+		// The deadline is set before every read, as the loop may have been blocked by slow transactions.
+		_ = conn.SetReadDeadline(time.Now().Add(websocketReadTimeout))
+		var data []byte
+		_, data, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		var req WebsocketRequest
+		if parseErr := json.Unmarshal(data, &req); parseErr != nil {
+			// A broken message doesn't mean the connection is broken, so just skip it.
+			as.Log.Warnln("Ignoring malformed websocket message:", parseErr)
+			continue
+		}
+		switch req.Command {
+		case WebsocketCommandTransaction:
+			transactions <- &req
+		case WebsocketCommandQueryAlias, WebsocketCommandQueryUser:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				as.handleWebsocketRequest(ctx, wc, &req)
+			}()
+		default:
+			as.Log.Debugfln("Ignoring unknown websocket command %q", req.Command)
+		}
+	}
+	close(transactions)
+	wg.Wait()
+	close(closed)
+	_ = conn.Close()
+	return true, err
+}
+
+func (as *AppService) handleWebsocketRequest(ctx context.Context, wc *websocketConn, req *WebsocketRequest) {
+	var respErr *Error
+	switch req.Command {
+	case WebsocketCommandTransaction:
+		if len(req.TxnID) == 0 {
+			respErr = &Error{
+				ErrorCode:  ErrNoTransactionID,
+				HTTPStatus: http.StatusBadRequest,
+				Message:    "Missing transaction ID.",
+			}
+		} else if len(req.Data) == 0 {
+			respErr = &Error{
+				ErrorCode:  ErrNoBody,
+				HTTPStatus: http.StatusBadRequest,
+				Message:    "Missing request body.",
+			}
+		} else {
+			respErr = as.handleTransaction(ctx, req.TxnID, req.Data)
+		}
+	case WebsocketCommandQueryAlias:
+		respErr = as.handleAliasQuery(ctx, req.Alias)
+	case WebsocketCommandQueryUser:
+		respErr = as.handleUserQuery(ctx, req.UserID)
+	}
+	err := wc.respond(req, respErr)
+	if err != nil {
+		as.Log.Debugfln("Failed to send response to websocket request %d: %v", req.ID, err)
+	}
+}
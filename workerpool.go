@@ -0,0 +1,184 @@
+// Copyright (c) 2020 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens to events when the queue of the WorkerPool mode is full.
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock makes dispatching wait until there's space in the queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the event that has been in the queue the longest to make space for the new one.
+	OverflowDropOldest
+	// OverflowReject drops the new event.
+	OverflowReject
+)
+
+// PoolConfig contains the settings of the WorkerPool mode.
+type PoolConfig struct {
+	// Workers is the number of goroutines that call handlers.
+	Workers int
+	// QueueSize is the number of events that can wait for a free worker.
+	QueueSize int
+	// Overflow is what happens when an event is dispatched while the queue is full.
+	// The handlers of dropped events aren't called. Dropped events are reported to transaction end hooks
+	// in Transaction.Failed and stay pending in the Journal, so they're replayed after a restart.
+	Overflow OverflowPolicy
+}
+
+// DefaultPoolConfig is the default PoolConfig of new EventProcessors.
+var DefaultPoolConfig = PoolConfig{
+	Workers:   16,
+	QueueSize: 1024,
+	Overflow:  OverflowBlock,
+}
+
+// PoolStats contains the current utilization of the worker pool of an EventProcessor.
+type PoolStats struct {
+	Workers       int `json:"workers"`
+	BusyWorkers   int `json:"busy_workers"`
+	QueueDepth    int `json:"queue_depth"`
+	QueueCapacity int `json:"queue_capacity"`
+	// DroppedEvents is the number of events that were dropped because the queue was full.
+	DroppedEvents uint64 `json:"dropped_events"`
+}
+
+type workerPool struct {
+	config  PoolConfig
+	queue   chan pendingEvent
+	busy    int32
+	dropped uint64
+	// lock makes dropping the oldest event and queueing the new one atomic.
+	lock sync.Mutex
+	// sendLock is held for reading while sending to the queue, so that stopPool doesn't close it under a sender.
+	sendLock sync.RWMutex
+	stopped  bool
+	workers  sync.WaitGroup
+}
+
+// getPool returns the worker pool, starting it first if it isn't running and create is true.
+func (ep *EventProcessor) getPool(create bool) *workerPool {
+	ep.poolLock.Lock()
+	defer ep.poolLock.Unlock()
+	if ep.pool == nil && create {
+		ep.pool = ep.startPool()
+	}
+	return ep.pool
+}
+
+func (ep *EventProcessor) startPool() *workerPool {
+	config := ep.Pool
+	if config.Workers <= 0 {
+		config.Workers = DefaultPoolConfig.Workers
+	}
+	if config.QueueSize < 0 {
+		config.QueueSize = 0
+	}
+	if config.Overflow == OverflowDropOldest && config.QueueSize == 0 {
+		// There must be something in the queue to drop.
+		config.QueueSize = 1
+	}
+	pool := &workerPool{
+		config: config,
+		queue:  make(chan pendingEvent, config.QueueSize),
+	}
+	pool.workers.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go ep.poolWorker(pool)
+	}
+	return pool
+}
+
+// stopPool closes the queue of the worker pool and waits for the workers to handle the remaining events and exit.
+// The next event dispatched in the WorkerPool mode starts a new pool.
+func (ep *EventProcessor) stopPool() {
+	ep.poolLock.Lock()
+	pool := ep.pool
+	ep.pool = nil
+	ep.poolLock.Unlock()
+	if pool == nil {
+		return
+	}
+	pool.sendLock.Lock()
+	pool.stopped = true
+	close(pool.queue)
+	pool.sendLock.Unlock()
+	pool.workers.Wait()
+}
+
+func (ep *EventProcessor) poolWorker(pool *workerPool) {
+	defer pool.workers.Done()
+	for pe := range pool.queue {
+		atomic.AddInt32(&pool.busy, 1)
+		ep.runPending(pe)
+		atomic.AddInt32(&pool.busy, -1)
+	}
+}
+
+func (ep *EventProcessor) dropPending(pool *workerPool, pe pendingEvent) {
+	atomic.AddUint64(&pool.dropped, 1)
+	ep.log.Warnfln("Worker pool queue is full, dropping %s (%s) in %s", pe.evt.ID, pe.evt.Type.Type, pe.evt.RoomID)
+	ep.as.markEventDropped(pe.evt)
+}
+
+// queuePoolEvent passes an event to the worker pool, starting the pool on first use.
+func (ep *EventProcessor) queuePoolEvent(pe pendingEvent) {
+	pool := ep.getPool(true)
+	pool.sendLock.RLock()
+	defer pool.sendLock.RUnlock()
+	if pool.stopped {
+		// The pool was stopped after getPool returned it, so the event can't be handled anymore.
+		ep.as.markEventDropped(pe.evt)
+		return
+	}
+	switch pool.config.Overflow {
+	case OverflowBlock:
+		pool.queue <- pe
+	case OverflowReject:
+		select {
+		case pool.queue <- pe:
+		default:
+			ep.dropPending(pool, pe)
+		}
+	case OverflowDropOldest:
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		for {
+			select {
+			case pool.queue <- pe:
+				return
+			default:
+			}
+			select {
+			case oldest := <-pool.queue:
+				ep.dropPending(pool, oldest)
+			default:
+			}
+		}
+	}
+}
+
+// PoolStats returns the current utilization of the worker pool.
+// The stats are empty if the WorkerPool mode hasn't been used.
+func (ep *EventProcessor) PoolStats() PoolStats {
+	pool := ep.getPool(false)
+	if pool == nil {
+		return PoolStats{}
+	}
+	return PoolStats{
+		Workers:       pool.config.Workers,
+		BusyWorkers:   int(atomic.LoadInt32(&pool.busy)),
+		QueueDepth:    len(pool.queue),
+		QueueCapacity: cap(pool.queue),
+		DroppedEvents: atomic.LoadUint64(&pool.dropped),
+	}
+}